@@ -4,12 +4,15 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/require"
 
+	"github.com/ASRafalsky/telemetry/internal/types"
 	"github.com/ASRafalsky/telemetry/pkg/services/poller"
 	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
 	"github.com/ASRafalsky/telemetry/pkg/services/repository"
@@ -17,7 +20,7 @@ import (
 
 func TestAgent(t *testing.T) {
 	var (
-		gFound, cFound bool
+		gFound, cFound atomic.Bool
 	)
 
 	// Add handlers and router.
@@ -25,7 +28,7 @@ func TestAgent(t *testing.T) {
 		return func(w http.ResponseWriter, r *http.Request) {
 			require.Equal(t, r.Header.Get("Content-Type"), "text/plain")
 			if chi.URLParam(r, "name") == "RandomValue" {
-				gFound = true
+				gFound.Store(true)
 			}
 		}
 	}
@@ -33,7 +36,7 @@ func TestAgent(t *testing.T) {
 		return func(w http.ResponseWriter, r *http.Request) {
 			require.Equal(t, r.Header.Get("Content-Type"), "text/plain")
 			if chi.URLParam(r, "name") == "PollCount" {
-				cFound = true
+				cFound.Store(true)
 			}
 		}
 	}
@@ -63,9 +66,131 @@ func TestAgent(t *testing.T) {
 
 	repos := repository.NewRepositories()
 
-	go poller.Poll(ctx, 20*time.Millisecond, repos)
+	collector, err := poller.NewCollector("runtime", poller.Config{Interval: 20 * time.Millisecond})
+	require.NoError(t, err)
+	go poller.Poll(ctx, repos, collector)
 	go reporter.Send(ctx, srv.URL, 100*time.Millisecond, client, repos)
 
-	require.Eventually(t, func() bool { return gFound && cFound }, 200*time.Millisecond, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return gFound.Load() && cFound.Load() }, 200*time.Millisecond, 50*time.Millisecond)
 	cancel()
 }
+
+func TestAgentApply(t *testing.T) {
+	cfg := defaultConfig()
+	a := &agent{}
+	collectors, reportCfg, err := a.apply(cfg)
+	require.NoError(t, err)
+	require.Len(t, collectors, 2)
+	require.Equal(t, "http://:8080", reportCfg.Addr)
+	require.Equal(t, 10*time.Second, reportCfg.Interval)
+
+	// Collectors with unchanged config are reused.
+	cfg.report = 5 * time.Second
+	cfg.collectorSettings = map[string]collectorSettings{"host": {interval: time.Minute}}
+	next, reportCfg, err := a.apply(cfg)
+	require.NoError(t, err)
+	require.Len(t, next, 2)
+	require.Same(t, collectors[0], next[0])
+	require.NotSame(t, collectors[1], next[1])
+	require.Equal(t, time.Minute, next[1].Interval())
+	require.Equal(t, 5*time.Second, reportCfg.Interval)
+
+	// Disabled collectors are removed.
+	cfg.collectors = []string{"host"}
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	require.Len(t, next, 1)
+	require.Equal(t, "host", next[0].Name())
+
+	// StatsD metrics are flushed by the collector at the poll interval.
+	cfg.statsdAddr = "127.0.0.1:8125"
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	require.Len(t, next, 2)
+	require.Equal(t, "statsd", next[1].Name())
+	require.Equal(t, 2*time.Second, next[1].Interval())
+	statsdCollector := next[1]
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	require.Same(t, statsdCollector, next[1])
+	cfg.polling = time.Second
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	require.NotSame(t, statsdCollector, next[1])
+	require.Equal(t, time.Second, next[1].Interval())
+
+	// Aligned collectors are equal on reload, so they keep running.
+	cfg.alignPolls = true
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	again, _, err := a.apply(cfg)
+	require.NoError(t, err)
+	require.True(t, next[0] == again[0])
+	require.Equal(t, "host", again[0].Name())
+
+	// Metrics of the agent are recorded by the collector at the poll interval.
+	cfg.alignPolls, cfg.selfTelemetry = false, true
+	next, _, err = a.apply(cfg)
+	require.NoError(t, err)
+	require.Len(t, next, 3)
+	require.Equal(t, "telemetry", next[2].Name())
+	require.Equal(t, time.Second, next[2].Interval())
+}
+
+func TestAgentReloadStopped(t *testing.T) {
+	args := os.Args
+	os.Args = []string{"agent"}
+	t.Cleanup(func() { os.Args = args })
+
+	a := &agent{}
+	_, _, err := a.apply(defaultConfig())
+	require.NoError(t, err)
+
+	// The poller and the reporter are stopped, so nobody receives the new setup.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.reload(ctx, make(chan []poller.Collector), make(chan reporter.Config))
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reload is blocked after stop")
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	repos := repository.NewRepositories()
+	pollStats := &poller.Stats{}
+	tm := newTelemetry(pollStats, &reporter.Stats{})
+	c := tm.collector(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		poller.PollWithReload(ctx, repos, nil, pollStats, c)
+		close(done)
+	}()
+	// The collector records its own polls, the counter has the total of the previous poll.
+	polls := types.SeriesKey(types.SelfPrefix+"polls_total", types.Labels{"collector": "telemetry"})
+	require.Eventually(t, func() bool {
+		value, ok := repos[repository.Counter].Get(polls)
+		return ok && types.BytesToCounter(value) >= 3
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	value, ok := repos[repository.Counter].Get(polls)
+	require.True(t, ok)
+	require.Equal(t, pollStats.Collectors()[0].Polls-1, int64(types.BytesToCounter(value)))
+	for _, name := range []string{"queue_depth", "request_duration_seconds_sum"} {
+		_, ok = repos[repository.Gauge].Get(types.SelfPrefix + name)
+		require.True(t, ok, name)
+	}
+	_, ok = repos[repository.Gauge].Get(types.SeriesKey(types.SelfPrefix+"poll_duration_seconds", types.Labels{"collector": "telemetry"}))
+	require.True(t, ok)
+	_, ok = repos[repository.Metadata].Get(repository.MetadataKey(repository.Counter, types.SelfPrefix+"polls_total"))
+	require.True(t, ok)
+}
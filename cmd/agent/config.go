@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
+	"github.com/ASRafalsky/telemetry/pkg/services/poller"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
+)
+
+// Labels of the agent identity added to every metric.
+const (
+	hostLabel     = "host"
+	instanceLabel = "instance_id"
+)
+
+type config struct {
+	// path of the config file, it is watched for changes.
+	path string
+	// addrs are the servers, metrics are distributed between them according to the mode.
+	addrs   []string
+	mode    reporter.Mode
+	polling time.Duration
+	report  time.Duration
+	// reportJitter is the max random delay of every report.
+	reportJitter time.Duration
+	// alignPolls makes collectors poll at multiples of their intervals on the wall clock.
+	alignPolls bool
+	// selfTelemetry makes the agent report its own metrics under types.SelfPrefix, it is off by default.
+	selfTelemetry bool
+	batch         bool
+	batchSize     int
+	gzip          bool
+	retries       []time.Duration
+	rateLimit     int
+	queueSize     int
+	// key signs requests with HMAC-SHA256 if it is set.
+	key string
+	// instanceID identifies the agent, hostname is used if it is empty.
+	instanceID string
+	// labelHost adds the host label to every metric besides the instance ID.
+	labelHost bool
+	// tags are static labels added to every metric.
+	tags map[string]string
+	// collectors are names of the enabled collectors.
+	collectors []string
+	// collectorSettings are optional settings of collectors by name.
+	collectorSettings map[string]collectorSettings
+	// outboxDir enables the on-disk queue of requests if it is set.
+	outboxDir     string
+	outboxMaxSize int64
+	outboxMaxAge  time.Duration
+	// shutdownTimeout limits the final report on stop.
+	shutdownTimeout time.Duration
+	// statsdAddr and statsdSocket enable StatsD listeners on UDP address and unix datagram socket.
+	statsdAddr   string
+	statsdSocket string
+}
+
+type collectorSettings struct {
+	// interval overrides the poll interval if it is positive.
+	interval time.Duration
+	params   map[string]string
+}
+
+func defaultConfig() config {
+	return config{
+		addrs:           []string{":8080"},
+		mode:            reporter.Failover,
+		polling:         2 * time.Second,
+		report:          10 * time.Second,
+		retries:         []time.Duration{time.Second, 3 * time.Second, 5 * time.Second},
+		rateLimit:       1,
+		queueSize:       256,
+		collectors:      []string{"runtime", "host"},
+		outboxMaxSize:   64 << 20,
+		outboxMaxAge:    24 * time.Hour,
+		shutdownTimeout: 5 * time.Second,
+	}
+}
+
+// collectorConfig returns config of the collector created by the registry.
+func (cfg config) collectorConfig(name string) poller.Config {
+	c := poller.Config{Interval: cfg.polling}
+	if s, ok := cfg.collectorSettings[name]; ok {
+		if s.interval > 0 {
+			c.Interval = s.interval
+		}
+		c.Params = s.params
+	}
+	return c
+}
+
+// identity returns labels added to every reported metric and the source ID of the agent on the host.
+// Every metric is labelled by the instance ID, which defaults to hostname, so series of agents don't mix.
+func (cfg config) identity(hostname string) (types.Labels, string) {
+	labels := make(types.Labels, len(cfg.tags)+2)
+	maps.Copy(labels, cfg.tags)
+	if cfg.labelHost && hostname != "" {
+		labels[hostLabel] = hostname
+	}
+	sourceID := hostname
+	if cfg.instanceID != "" {
+		sourceID = cfg.instanceID
+	}
+	if sourceID != "" {
+		labels[instanceLabel] = sourceID
+	}
+	return labels, sourceID
+}
+
+// validate returns an error for every invalid field.
+func (cfg config) validate() error {
+	var errs error
+	check := func(ok bool, field string, format string, args ...any) {
+		if !ok {
+			errs = multierr.Append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+		}
+	}
+
+	check(len(cfg.addrs) > 0, "address", "must not be empty")
+	check(cfg.polling > 0, "poll_interval", "must be positive, got %v", cfg.polling)
+	check(cfg.report > 0, "report_interval", "must be positive, got %v", cfg.report)
+	check(cfg.reportJitter >= 0, "report_jitter", "must not be negative, got %v", cfg.reportJitter)
+	check(cfg.batchSize >= 0, "transport.batch_size", "must not be negative, got %d", cfg.batchSize)
+	check(cfg.rateLimit > 0, "transport.rate_limit", "must be positive, got %d", cfg.rateLimit)
+	check(cfg.queueSize > 0, "transport.queue_size", "must be positive, got %d", cfg.queueSize)
+	for i, d := range cfg.retries {
+		check(d >= 0, fmt.Sprintf("transport.retries[%d]", i), "must not be negative, got %v", d)
+	}
+	check(cfg.shutdownTimeout >= 0, "transport.shutdown_timeout", "must not be negative, got %v", cfg.shutdownTimeout)
+	check(cfg.outboxMaxSize >= 0, "transport.outbox.max_size", "must not be negative, got %d", cfg.outboxMaxSize)
+	check(cfg.outboxMaxAge >= 0, "transport.outbox.max_age", "must not be negative, got %v", cfg.outboxMaxAge)
+	if err := naming.ValidateLabels(cfg.tags); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("tags: %w", err))
+	}
+	for _, label := range []string{hostLabel, instanceLabel} {
+		_, ok := cfg.tags[label]
+		check(!ok, "tags", "label %q is reserved for the agent identity", label)
+	}
+
+	registered := poller.Registered()
+	for _, name := range cfg.collectors {
+		check(slices.Contains(registered, name), "collectors", "unknown collector %q, expected one of %v", name, registered)
+	}
+	for name, s := range cfg.collectorSettings {
+		check(slices.Contains(registered, name), "collectors", "unknown collector %q, expected one of %v", name, registered)
+		check(s.interval >= 0, "collectors."+name+".interval", "must not be negative, got %v", s.interval)
+	}
+	return errs
+}
+
+// fileConfig is the config file, unset fields keep their values.
+type fileConfig struct {
+	Address        *string                  `json:"address" yaml:"address"`
+	PollInterval   *fileInterval            `json:"poll_interval" yaml:"poll_interval"`
+	ReportInterval *fileInterval            `json:"report_interval" yaml:"report_interval"`
+	ReportJitter   *string                  `json:"report_jitter" yaml:"report_jitter"`
+	AlignPolls     *bool                    `json:"align_polls" yaml:"align_polls"`
+	SelfTelemetry  *bool                    `json:"self_telemetry" yaml:"self_telemetry"`
+	Key            *string                  `json:"key" yaml:"key"`
+	InstanceID     *string                  `json:"instance_id" yaml:"instance_id"`
+	HostLabel      *bool                    `json:"host_label" yaml:"host_label"`
+	Tags           map[string]string        `json:"tags" yaml:"tags"`
+	Collectors     map[string]fileCollector `json:"collectors" yaml:"collectors"`
+	Transport      fileTransport            `json:"transport" yaml:"transport"`
+	StatsD         fileStatsD               `json:"statsd" yaml:"statsd"`
+}
+
+type fileCollector struct {
+	// Enabled is true if it is not set.
+	Enabled *bool `json:"enabled" yaml:"enabled"`
+	// Interval overrides the poll interval.
+	Interval *fileInterval     `json:"interval" yaml:"interval"`
+	Params   map[string]string `json:"params" yaml:"params"`
+}
+
+// fileInterval is a whole number of seconds or a duration like "500ms".
+type fileInterval string
+
+func (i *fileInterval) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		// A number is kept as is.
+		s = string(data)
+	}
+	*i = fileInterval(s)
+	return nil
+}
+
+func (i *fileInterval) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: interval must be a number or a string", value.Line)
+	}
+	*i = fileInterval(value.Value)
+	return nil
+}
+
+type fileTransport struct {
+	Batch           *bool      `json:"batch" yaml:"batch"`
+	BatchSize       *int       `json:"batch_size" yaml:"batch_size"`
+	Gzip            *bool      `json:"gzip" yaml:"gzip"`
+	Retries         *[]string  `json:"retries" yaml:"retries"`
+	RateLimit       *int       `json:"rate_limit" yaml:"rate_limit"`
+	Mode            *string    `json:"mode" yaml:"mode"`
+	QueueSize       *int       `json:"queue_size" yaml:"queue_size"`
+	ShutdownTimeout *string    `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	Outbox          fileOutbox `json:"outbox" yaml:"outbox"`
+}
+
+type fileOutbox struct {
+	Dir     *string `json:"dir" yaml:"dir"`
+	MaxSize *int64  `json:"max_size" yaml:"max_size"`
+	MaxAge  *string `json:"max_age" yaml:"max_age"`
+}
+
+type fileStatsD struct {
+	Address *string `json:"address" yaml:"address"`
+	Socket  *string `json:"socket" yaml:"socket"`
+}
+
+// loadFile applies JSON or YAML config file to cfg, the format is chosen by the file extension.
+func loadFile(path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var f fileConfig
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	default:
+		return fmt.Errorf("config file %s: unknown format %q, expected .json, .yaml or .yml", path, ext)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return f.apply(cfg)
+}
+
+// apply sets fields of cfg which are set in the file.
+func (f fileConfig) apply(cfg *config) error {
+	var errs error
+	duration := func(field string, value *string, dst *time.Duration) {
+		if value == nil {
+			return
+		}
+		d, err := time.ParseDuration(*value)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		*dst = d
+	}
+	interval := func(field string, value *fileInterval, dst *time.Duration) {
+		if value == nil {
+			return
+		}
+		d, err := parseInterval(string(*value))
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", field, err))
+			return
+		}
+		*dst = d
+	}
+	if f.Address != nil {
+		cfg.addrs = parseList(*f.Address)
+	}
+	interval("poll_interval", f.PollInterval, &cfg.polling)
+	interval("report_interval", f.ReportInterval, &cfg.report)
+	duration("report_jitter", f.ReportJitter, &cfg.reportJitter)
+	setIfSet(&cfg.alignPolls, f.AlignPolls)
+	setIfSet(&cfg.selfTelemetry, f.SelfTelemetry)
+	setIfSet(&cfg.key, f.Key)
+	setIfSet(&cfg.instanceID, f.InstanceID)
+	setIfSet(&cfg.labelHost, f.HostLabel)
+	if f.Tags != nil {
+		cfg.tags = f.Tags
+	}
+
+	t := f.Transport
+	setIfSet(&cfg.batch, t.Batch)
+	setIfSet(&cfg.batchSize, t.BatchSize)
+	setIfSet(&cfg.gzip, t.Gzip)
+	setIfSet(&cfg.rateLimit, t.RateLimit)
+	if t.Mode != nil {
+		mode, err := reporter.ParseMode(*t.Mode)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("transport.mode: %w", err))
+		} else {
+			cfg.mode = mode
+		}
+	}
+	setIfSet(&cfg.queueSize, t.QueueSize)
+	duration("transport.shutdown_timeout", t.ShutdownTimeout, &cfg.shutdownTimeout)
+	if t.Retries != nil {
+		cfg.retries = make([]time.Duration, len(*t.Retries))
+		for i, r := range *t.Retries {
+			duration(fmt.Sprintf("transport.retries[%d]", i), &r, &cfg.retries[i])
+		}
+	}
+	setIfSet(&cfg.outboxDir, t.Outbox.Dir)
+	setIfSet(&cfg.outboxMaxSize, t.Outbox.MaxSize)
+	duration("transport.outbox.max_age", t.Outbox.MaxAge, &cfg.outboxMaxAge)
+	setIfSet(&cfg.statsdAddr, f.StatsD.Address)
+	setIfSet(&cfg.statsdSocket, f.StatsD.Socket)
+
+	if f.Collectors != nil {
+		cfg.collectors = nil
+		cfg.collectorSettings = make(map[string]collectorSettings, len(f.Collectors))
+		for name, c := range f.Collectors {
+			if c.Enabled == nil || *c.Enabled {
+				cfg.collectors = append(cfg.collectors, name)
+			}
+			s := collectorSettings{params: c.Params}
+			interval("collectors."+name+".interval", c.Interval, &s.interval)
+			cfg.collectorSettings[name] = s
+		}
+		sort.Strings(cfg.collectors)
+	}
+	return errs
+}
+
+// setIfSet sets dst to the value if it is set.
+func setIfSet[T any](dst *T, value *T) {
+	if value != nil {
+		*dst = *value
+	}
+}
@@ -2,41 +2,243 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
 )
 
-func parseFlags() (addr string, polling int, report int) {
-	var (
-		err error
-	)
+// setting is a config field which can be set by a flag and an environment variable.
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	// allowEmpty makes an empty environment variable override the value.
+	allowEmpty bool
+	set        func(cfg *config, value string) error
+}
+
+var settings = []setting{
+	{flag: "a", env: "ADDRESS", usage: "comma separated addresses and ports of the servers",
+		set: func(cfg *config, value string) error {
+			cfg.addrs = parseList(value)
+			return nil
+		}},
+	{flag: "mode", env: "REPORT_MODE", usage: "failover sends metrics to the first healthy server, broadcast sends them to all servers",
+		set: func(cfg *config, value string) error {
+			mode, err := reporter.ParseMode(value)
+			if err != nil {
+				return err
+			}
+			cfg.mode = mode
+			return nil
+		}},
+	{flag: "p", env: "POLL_INTERVAL", usage: "poll interval in seconds or as a duration like 500ms", set: intervalSetter(func(cfg *config) *time.Duration { return &cfg.polling })},
+	{flag: "r", env: "REPORT_INTERVAL", usage: "report interval in seconds or as a duration like 1m", set: intervalSetter(func(cfg *config) *time.Duration { return &cfg.report })},
+	{flag: "report-jitter", env: "REPORT_JITTER", usage: "max random delay of every report", set: durationSetter(func(cfg *config) *time.Duration { return &cfg.reportJitter })},
+	{flag: "align-polls", env: "ALIGN_POLLS", usage: "poll at multiples of the interval on the wall clock", isBool: true, set: boolSetter(func(cfg *config) *bool { return &cfg.alignPolls })},
+	{flag: "instance-id", env: "INSTANCE_ID", usage: "ID of the agent added to every metric as the instance_id label, hostname is used if it is empty", allowEmpty: true, set: stringSetter(func(cfg *config) *string { return &cfg.instanceID })},
+	{flag: "host-label", env: "HOST_LABEL", usage: "add the host label with hostname to every metric", isBool: true, set: boolSetter(func(cfg *config) *bool { return &cfg.labelHost })},
+	{flag: "tags", env: "TAGS", usage: "comma separated name=value labels added to every metric", allowEmpty: true,
+		set: func(cfg *config, value string) error {
+			tags, err := parseTags(value)
+			if err != nil {
+				return err
+			}
+			cfg.tags = tags
+			return nil
+		}},
+	{flag: "self-telemetry", env: "SELF_TELEMETRY", usage: "report metrics of the agent itself", isBool: true, set: boolSetter(func(cfg *config) *bool { return &cfg.selfTelemetry })},
+	{flag: "k", env: "KEY", usage: "key to sign requests with HMAC-SHA256", set: stringSetter(func(cfg *config) *string { return &cfg.key })},
+	{flag: "collectors", env: "COLLECTORS", usage: "comma separated names of the enabled collectors", allowEmpty: true,
+		set: func(cfg *config, value string) error {
+			cfg.collectors = parseList(value)
+			return nil
+		}},
+	{flag: "batch", env: "BATCH", usage: "send gauges and counters in JSON batches", isBool: true, set: boolSetter(func(cfg *config) *bool { return &cfg.batch })},
+	{flag: "batch-size", env: "BATCH_SIZE", usage: "max size of JSON batch in bytes, 0 means no limit", set: intSetter(func(cfg *config) *int { return &cfg.batchSize })},
+	{flag: "gzip", env: "GZIP", usage: "compress JSON batches with gzip", isBool: true, set: boolSetter(func(cfg *config) *bool { return &cfg.gzip })},
+	{flag: "retries", env: "RETRY_SCHEDULE", usage: "comma separated delays before retries of failed requests", allowEmpty: true,
+		set: func(cfg *config, value string) error {
+			retries, err := parseDurations(value)
+			if err != nil {
+				return err
+			}
+			cfg.retries = retries
+			return nil
+		}},
+	{flag: "l", env: "RATE_LIMIT", usage: "max number of concurrent requests to the server", set: intSetter(func(cfg *config) *int { return &cfg.rateLimit })},
+	{flag: "queue-size", env: "QUEUE_SIZE", usage: "max number of requests waiting to be sent", set: intSetter(func(cfg *config) *int { return &cfg.queueSize })},
+	{flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", usage: "max duration of the final report on stop", set: durationSetter(func(cfg *config) *time.Duration { return &cfg.shutdownTimeout })},
+	{flag: "outbox-dir", env: "OUTBOX_DIR", usage: "directory of the on-disk queue of requests, empty means no queue", allowEmpty: true, set: stringSetter(func(cfg *config) *string { return &cfg.outboxDir })},
+	{flag: "outbox-max-size", env: "OUTBOX_MAX_SIZE", usage: "max size of the on-disk queue in bytes, 0 means no limit",
+		set: func(cfg *config, value string) error {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			cfg.outboxMaxSize = size
+			return nil
+		}},
+	{flag: "outbox-max-age", env: "OUTBOX_MAX_AGE", usage: "max age of requests in the on-disk queue, 0 means no limit", set: durationSetter(func(cfg *config) *time.Duration { return &cfg.outboxMaxAge })},
+	{flag: "statsd", env: "STATSD_ADDRESS", usage: "UDP address of the StatsD listener, empty means no listener", allowEmpty: true, set: stringSetter(func(cfg *config) *string { return &cfg.statsdAddr })},
+	{flag: "statsd-socket", env: "STATSD_SOCKET", usage: "unix datagram socket of the StatsD listener, empty means no listener", allowEmpty: true, set: stringSetter(func(cfg *config) *string { return &cfg.statsdSocket })},
+}
+
+func parseFlags() (config, error) {
+	return parseConfig(os.Args[1:], os.LookupEnv)
+}
+
+// parseConfig returns defaults overridden by the config file, then by environment variables and then by flags.
+// It returns an error for every invalid value.
+func parseConfig(args []string, lookupEnv func(string) (string, bool)) (config, error) {
+	type flagValue struct {
+		setting
+		value string
+	}
+	var flagValues []flagValue
+
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	configPath := fs.String("c", "", "path to JSON or YAML config file")
+	for _, s := range settings {
+		record := func(value string) error {
+			flagValues = append(flagValues, flagValue{setting: s, value: value})
+			return nil
+		}
+		if s.isBool {
+			fs.BoolFunc(s.flag, s.usage, record)
+		} else {
+			fs.Func(s.flag, s.usage, record)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+
+	cfg := defaultConfig()
+	var errs error
+	if *configPath == "" {
+		*configPath, _ = lookupEnv("CONFIG")
+	}
+	if *configPath != "" {
+		cfg.path = *configPath
+		errs = multierr.Append(errs, loadFile(*configPath, &cfg))
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok && (value != "" || s.allowEmpty) {
+			if err := s.set(&cfg, value); err != nil {
+				errs = multierr.Append(errs, fmt.Errorf("%s %q: %w", s.env, value, err))
+			}
+		}
+	}
+	for _, f := range flagValues {
+		if err := f.set(&cfg, f.value); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("-%s %q: %w", f.flag, f.value, err))
+		}
+	}
+
+	return cfg, multierr.Append(errs, cfg.validate())
+}
 
-	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
-		addr = envRunAddr
+func stringSetter(field func(cfg *config) *string) func(cfg *config, value string) error {
+	return func(cfg *config, value string) error {
+		*field(cfg) = value
+		return nil
 	}
-	if addr == "" {
-		flag.StringVar(&addr, "a", ":8080", "address and port to run server")
+}
+
+func intSetter(field func(cfg *config) *int) func(cfg *config, value string) error {
+	return func(cfg *config, value string) error {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = v
+		return nil
 	}
+}
 
-	if envReportInterval := os.Getenv("REPORT_INTERVAL"); envReportInterval != "" {
-		if report, err = strconv.Atoi(envReportInterval); err != nil {
-			report = 0
+func boolSetter(field func(cfg *config) *bool) func(cfg *config, value string) error {
+	return func(cfg *config, value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
 		}
+		*field(cfg) = v
+		return nil
 	}
-	if report == 0 {
-		flag.IntVar(&report, "r", 10, "send data time interval")
+}
+
+func durationSetter(field func(cfg *config) *time.Duration) func(cfg *config, value string) error {
+	return func(cfg *config, value string) error {
+		v, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = v
+		return nil
 	}
+}
 
-	if envPollInterval := os.Getenv("POLL_INTERVAL"); envPollInterval != "" {
-		if polling, err = strconv.Atoi(envPollInterval); err != nil {
-			polling = 0
+func intervalSetter(field func(cfg *config) *time.Duration) func(cfg *config, value string) error {
+	return func(cfg *config, value string) error {
+		v, err := parseInterval(value)
+		if err != nil {
+			return err
 		}
+		*field(cfg) = v
+		return nil
+	}
+}
+
+// parseInterval parses a whole number of seconds or a duration like "500ms".
+func parseInterval(s string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second, nil
 	}
-	if polling == 0 {
-		flag.IntVar(&polling, "p", 2, "get data time interval")
+	return time.ParseDuration(s)
+}
+
+// parseDurations parses comma separated list of durations.
+func parseDurations(s string) ([]time.Duration, error) {
+	var res []time.Duration
+	for _, item := range parseList(s) {
+		d, err := time.ParseDuration(item)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
 	}
+	return res, nil
+}
 
-	flag.Parse()
+// parseTags parses comma separated list of name=value pairs.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, item := range parseList(s) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q must be name=value", item)
+		}
+		tags[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
 
-	return addr, polling, report
+// parseList parses comma separated list skipping empty items.
+func parseList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
 }
@@ -1,14 +1,204 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
 )
 
+// env returns lookup function over the variables.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	return path
+}
+
 func TestParseFlags_Default(t *testing.T) {
-	addr, polling, report := parseFlags()
-	require.Equal(t, ":8080", addr)
-	require.Equal(t, 2, polling)
-	require.Equal(t, 10, report)
+	cfg, err := parseConfig(nil, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, []string{":8080"}, cfg.addrs)
+	require.Equal(t, reporter.Failover, cfg.mode)
+	require.Equal(t, 2*time.Second, cfg.polling)
+	require.Equal(t, 10*time.Second, cfg.report)
+	require.Zero(t, cfg.reportJitter)
+	require.False(t, cfg.alignPolls)
+	require.False(t, cfg.selfTelemetry)
+	// Hostname identifies the agent by default.
+	labels, sourceID := cfg.identity("node1")
+	require.Equal(t, types.Labels{"instance_id": "node1"}, labels)
+	require.Equal(t, "node1", sourceID)
+	require.False(t, cfg.batch)
+	require.Zero(t, cfg.batchSize)
+	require.False(t, cfg.gzip)
+	require.Empty(t, cfg.key)
+	require.Equal(t, 1, cfg.rateLimit)
+	require.Equal(t, 256, cfg.queueSize)
+	require.Equal(t, []string{"runtime", "host"}, cfg.collectors)
+	require.Empty(t, cfg.outboxDir)
+	require.Equal(t, int64(64<<20), cfg.outboxMaxSize)
+	require.Equal(t, 24*time.Hour, cfg.outboxMaxAge)
+	require.Equal(t, 5*time.Second, cfg.shutdownTimeout)
+	require.Equal(t, []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}, cfg.retries)
+}
+
+func TestParseConfig(t *testing.T) {
+	yamlConfig := `
+address: file:8080,backup:8080
+poll_interval: 1
+report_interval: 5s
+report_jitter: 500ms
+align_polls: true
+key: file-key
+instance_id: agent-1
+host_label: true
+tags:
+  env: prod
+collectors:
+  runtime:
+  host:
+    enabled: false
+    interval: 250ms
+    params:
+      root: /host/proc
+transport:
+  batch: true
+  batch_size: 1024
+  retries: [1s, 2s]
+  rate_limit: 4
+  mode: broadcast
+  outbox:
+    dir: /var/lib/agent
+    max_age: 1h
+statsd:
+  address: 127.0.0.1:8125
+`
+	jsonConfig := `{
+  "address": "file:8080,backup:8080",
+  "poll_interval": 1,
+  "report_interval": "5s",
+  "report_jitter": "500ms",
+  "align_polls": true,
+  "key": "file-key",
+  "instance_id": "agent-1",
+  "host_label": true,
+  "tags": {"env": "prod"},
+  "collectors": {"runtime": {}, "host": {"enabled": false, "interval": "250ms", "params": {"root": "/host/proc"}}},
+  "transport": {
+    "batch": true,
+    "batch_size": 1024,
+    "retries": ["1s", "2s"],
+    "rate_limit": 4,
+    "mode": "broadcast",
+    "outbox": {"dir": "/var/lib/agent", "max_age": "1h"}
+  },
+  "statsd": {"address": "127.0.0.1:8125"}
+}`
+
+	for name, data := range map[string]string{"agent.yaml": yamlConfig, "agent.json": jsonConfig} {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, name, data)
+
+			cfg, err := parseConfig([]string{"-c", path}, env(nil))
+			require.NoError(t, err)
+			require.Equal(t, []string{"file:8080", "backup:8080"}, cfg.addrs)
+			require.Equal(t, reporter.Broadcast, cfg.mode)
+			require.Equal(t, time.Second, cfg.polling)
+			require.Equal(t, 5*time.Second, cfg.report)
+			require.Equal(t, 500*time.Millisecond, cfg.reportJitter)
+			require.True(t, cfg.alignPolls)
+			require.Equal(t, "file-key", cfg.key)
+			labels, sourceID := cfg.identity("node1")
+			require.Equal(t, types.Labels{"host": "node1", "instance_id": "agent-1", "env": "prod"}, labels)
+			require.Equal(t, "agent-1", sourceID)
+			require.Equal(t, []string{"runtime"}, cfg.collectors)
+			require.Equal(t, "/host/proc", cfg.collectorConfig("host").Params["root"])
+			require.Equal(t, 250*time.Millisecond, cfg.collectorConfig("host").Interval)
+			require.Equal(t, time.Second, cfg.collectorConfig("runtime").Interval)
+			require.True(t, cfg.batch)
+			require.Equal(t, 1024, cfg.batchSize)
+			require.Equal(t, []time.Duration{time.Second, 2 * time.Second}, cfg.retries)
+			require.Equal(t, 4, cfg.rateLimit)
+			require.Equal(t, "/var/lib/agent", cfg.outboxDir)
+			require.Equal(t, time.Hour, cfg.outboxMaxAge)
+			require.Equal(t, "127.0.0.1:8125", cfg.statsdAddr)
+			require.Empty(t, cfg.statsdSocket)
+			// Values not set in the file are defaults.
+			require.Equal(t, 256, cfg.queueSize)
+			require.Equal(t, 5*time.Second, cfg.shutdownTimeout)
+		})
+	}
+
+	t.Run("precedence", func(t *testing.T) {
+		path := writeConfig(t, "agent.yaml", yamlConfig)
+
+		// File < env < flags, the file is set by the env.
+		cfg, err := parseConfig([]string{"-r", "7", "-p", "500ms", "-gzip", "-self-telemetry"}, env(map[string]string{
+			"CONFIG":          path,
+			"ADDRESS":         "env:8080",
+			"REPORT_INTERVAL": "6",
+			"POLL_INTERVAL":   "3",
+			"REPORT_JITTER":   "2s",
+			"TAGS":            "env=dev, team=core",
+			"HOST_LABEL":      "false",
+			"COLLECTORS":      "runtime,host",
+		}))
+		require.NoError(t, err)
+		require.Equal(t, []string{"env:8080"}, cfg.addrs)
+		require.Equal(t, 500*time.Millisecond, cfg.polling)
+		require.Equal(t, 7*time.Second, cfg.report)
+		require.Equal(t, 2*time.Second, cfg.reportJitter)
+		require.True(t, cfg.selfTelemetry)
+		require.Equal(t, map[string]string{"env": "dev", "team": "core"}, cfg.tags)
+		require.False(t, cfg.labelHost)
+		require.True(t, cfg.gzip)
+		require.Equal(t, []string{"runtime", "host"}, cfg.collectors)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		path := writeConfig(t, "agent.yaml", `
+poll_interval: 0
+report_jitter: -1s
+tags:
+  host: other
+  bad-name: value
+transport:
+  retries: [1s, soon]
+`)
+		_, err := parseConfig([]string{"-c", path, "-l", "0", "-queue-size", "many", "-mode", "random"}, env(map[string]string{
+			"REPORT_INTERVAL": "often",
+			"COLLECTORS":      "runtime,unknown",
+		}))
+		require.Error(t, err)
+		errs := multierr.Errors(err)
+		require.Len(t, errs, 10, err)
+		for _, field := range []string{"transport.retries[1]", "REPORT_INTERVAL", "-queue-size", "-mode", "poll_interval",
+			"report_jitter", "transport.rate_limit", "collectors", `tags: label "host" is reserved`, "tags: invalid label name"} {
+			require.ErrorContains(t, err, field)
+		}
+	})
+
+	t.Run("unknown_field", func(t *testing.T) {
+		for name, data := range map[string]string{
+			"agent.yaml": "adress: localhost:8080\n",
+			"agent.json": `{"adress": "localhost:8080"}`,
+			"agent.toml": `address = "localhost:8080"`,
+		} {
+			_, err := parseConfig([]string{"-c", writeConfig(t, name, data)}, env(nil))
+			require.Error(t, err, name)
+		}
+	})
 }
@@ -3,24 +3,129 @@ package main
 import (
 	"context"
 	"fmt"
-	"time"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/ASRafalsky/telemetry/pkg/services/poller"
 	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
 	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+	"github.com/ASRafalsky/telemetry/pkg/services/statsd"
 )
 
 func main() {
-	addr, pollingPeriod, sendPeriod := parseFlags()
+	cfg, err := parseFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	client := NewClient()
-	ctx := context.Background()
+	a := &agent{}
+	collectors, reportCfg, err := a.apply(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	repos := repository.NewRepositories()
+	os.Exit(a.run(repository.NewRepositories(), collectors, reportCfg))
+}
+
+// run works until the agent gets a stop signal and returns exit code: 0 if the final report is delivered, 1 otherwise.
+// The config is reloaded on SIGHUP and when the config file changes.
+func (a *agent) run(repos map[string]repository.Repository, collectors []poller.Collector,
+	reportCfg reporter.Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// wg tracks the poller, StatsD listeners and the config watcher, which stop when ctx is done.
+	var wg sync.WaitGroup
+	if err := a.listenStatsD(ctx, &wg); err != nil {
+		fmt.Printf("Agent failed to start; %s\n", err)
+		stop()
+		wg.Wait()
+		return 1
+	}
+
+	changed := make(chan struct{}, 1)
+	if a.cfg.path != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchConfig(ctx, a.cfg.path, configWatchInterval, changed)
+		}()
+	}
 
-	fmt.Printf("Agent started with address: %s\n", "http://"+addr)
-	go poller.Poll(ctx, time.Duration(pollingPeriod)*time.Second, repos)
-	go reporter.Send(ctx, "http://"+addr, time.Duration(sendPeriod)*time.Second, client, repos)
+	fmt.Printf("Agent started with addresses: %s, mode %s\n", strings.Join(a.cfg.addrs, ","), a.cfg.mode)
+	pollReload := make(chan []poller.Collector)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		poller.PollWithReload(ctx, repos, pollReload, a.pollStats, collectors...)
+	}()
+
+	// The reporter is stopped after the poller, so the final report has the last polled values.
+	reportCtx, stopReport := context.WithCancel(context.Background())
+	defer stopReport()
+	reportReload := make(chan reporter.Config)
+	reportErr := make(chan error, 1)
+	go func() {
+		reportErr <- reporter.Send(reportCtx, reportCfg.Addr, reportCfg.Interval, reportCfg.Client, repos,
+			append(reportCfg.Options, reporter.WithReload(reportReload))...)
+	}()
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-hup:
+			a.reload(ctx, pollReload, reportReload)
+		case <-changed:
+			a.reload(ctx, pollReload, reportReload)
+		}
+	}
+	// The next signal kills the agent.
+	stop()
+	fmt.Println("Agent is stopping")
+
+	// StatsD metrics are not received while they are flushed and unix sockets are removed before exit.
+	wg.Wait()
+	if a.statsd != nil {
+		// Metrics received since the last poll are sent with the final report.
+		a.statsd.Flush(poller.NewSink(repos))
+	}
+	stopReport()
+	if err := <-reportErr; err != nil {
+		fmt.Printf("Agent stopped; %s\n", err)
+		return 1
+	}
+	fmt.Println("Agent stopped")
+	return 0
+}
 
-	<-ctx.Done()
+// listenStatsD starts StatsD listeners enabled by the config tracked by wg, they are stopped when ctx is done.
+func (a *agent) listenStatsD(ctx context.Context, wg *sync.WaitGroup) error {
+	if a.statsd == nil {
+		return nil
+	}
+	for _, l := range []struct{ network, addr string }{{"udp", a.cfg.statsdAddr}, {"unixgram", a.cfg.statsdSocket}} {
+		if l.addr == "" {
+			continue
+		}
+		conn, err := statsd.Listen(l.network, l.addr)
+		if err != nil {
+			return fmt.Errorf("StatsD listener: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.statsd.Serve(ctx, conn); err != nil {
+				fmt.Printf("[statsd] Listener stopped; %s\n", err)
+			}
+		}()
+	}
+	return nil
 }
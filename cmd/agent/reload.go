@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/outbox"
+	"github.com/ASRafalsky/telemetry/pkg/services/poller"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
+	"github.com/ASRafalsky/telemetry/pkg/services/statsd"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 5 * time.Second
+
+// agent keeps the applied config and the parts of the setup which are reused on reload.
+type agent struct {
+	cfg config
+	// collectors are the running collectors by name.
+	collectors map[string]collectorInstance
+	outbox     *outbox.Outbox
+	// statsd aggregates metrics received by StatsD listeners, it is nil if they are disabled.
+	statsd          *statsd.Server
+	statsdCollector poller.Collector
+	// pollStats and reportStats live as long as the agent, so the telemetry counters never go back.
+	pollStats          *poller.Stats
+	reportStats        *reporter.Stats
+	telemetry          *telemetry
+	telemetryCollector poller.Collector
+}
+
+type collectorInstance struct {
+	poller.Collector
+	cfg poller.Config
+}
+
+// apply creates collectors and reporter setup of cfg and makes cfg the applied one. Collectors with unchanged
+// config and the outbox with unchanged settings are reused, so their state is kept.
+func (a *agent) apply(cfg config) ([]poller.Collector, reporter.Config, error) {
+	instances := make(map[string]collectorInstance, len(cfg.collectors))
+	collectors := make([]poller.Collector, 0, len(cfg.collectors))
+	for _, name := range cfg.collectors {
+		c := collectorInstance{cfg: cfg.collectorConfig(name)}
+		if prev, ok := a.collectors[name]; ok && reflect.DeepEqual(prev.cfg, c.cfg) {
+			c.Collector = prev.Collector
+		} else {
+			var err error
+			if c.Collector, err = poller.NewCollector(name, c.cfg); err != nil {
+				return nil, reporter.Config{}, err
+			}
+		}
+		instances[name] = c
+		collectors = append(collectors, c.Collector)
+	}
+	if cfg.statsdAddr != "" || cfg.statsdSocket != "" {
+		if a.statsd == nil {
+			a.statsd = statsd.New()
+		}
+		// StatsD metrics are flushed to the repositories at the poll interval.
+		if a.statsdCollector == nil || a.statsdCollector.Interval() != cfg.polling {
+			a.statsdCollector = a.statsd.Collector(cfg.polling)
+		}
+		collectors = append(collectors, a.statsdCollector)
+	}
+	if a.pollStats == nil {
+		a.pollStats, a.reportStats = &poller.Stats{}, &reporter.Stats{}
+	}
+	if cfg.selfTelemetry {
+		if a.telemetry == nil {
+			a.telemetry = newTelemetry(a.pollStats, a.reportStats)
+		}
+		// Metrics of the agent are recorded at the poll interval.
+		if a.telemetryCollector == nil || a.telemetryCollector.Interval() != cfg.polling {
+			a.telemetryCollector = a.telemetry.collector(cfg.polling)
+		}
+		collectors = append(collectors, a.telemetryCollector)
+	}
+	if cfg.alignPolls {
+		for i, c := range collectors {
+			collectors[i] = poller.Aligned(c)
+		}
+	}
+
+	ob := a.outbox
+	if cfg.outboxDir != a.cfg.outboxDir || cfg.outboxMaxSize != a.cfg.outboxMaxSize ||
+		cfg.outboxMaxAge != a.cfg.outboxMaxAge || ob == nil {
+		ob = nil
+		if cfg.outboxDir != "" {
+			var err error
+			if ob, err = outbox.New(cfg.outboxDir, cfg.outboxMaxSize, cfg.outboxMaxAge); err != nil {
+				return nil, reporter.Config{}, err
+			}
+		}
+	}
+
+	opts := []reporter.Option{
+		reporter.WithRetries(cfg.retries...),
+		reporter.WithFinalReport(cfg.shutdownTimeout),
+		reporter.WithRateLimit(cfg.rateLimit),
+		reporter.WithQueueSize(cfg.queueSize),
+		reporter.WithJitter(cfg.reportJitter),
+		reporter.WithStats(a.reportStats),
+	}
+	if cfg.batch {
+		opts = append(opts, reporter.WithBatch(cfg.batchSize))
+	}
+	if cfg.gzip {
+		opts = append(opts, reporter.WithGzip())
+	}
+	if cfg.key != "" {
+		opts = append(opts, reporter.WithKey(cfg.key))
+	}
+	if ob != nil {
+		opts = append(opts, reporter.WithOutbox(ob))
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		fmt.Printf("[agent] Failed to get hostname; %s\n", err)
+	}
+	labels, sourceID := cfg.identity(hostname)
+	opts = append(opts, reporter.WithLabels(labels))
+	if sourceID != "" {
+		opts = append(opts, reporter.WithSourceID(sourceID))
+	}
+	addrs := make([]string, 0, len(cfg.addrs))
+	for _, addr := range cfg.addrs {
+		addrs = append(addrs, "http://"+addr)
+	}
+	opts = append(opts, reporter.WithFanout(cfg.mode, addrs[1:]...))
+
+	a.cfg, a.collectors, a.outbox = cfg, instances, ob
+	return collectors, reporter.Config{
+		Addr:     addrs[0],
+		Interval: cfg.report,
+		Client:   NewClient(),
+		Options:  opts,
+	}, nil
+}
+
+// reload reads the config again and passes the new setup to the poller and the reporter.
+// An invalid config is not applied. The poller doesn't receive the setup after ctx is done, so reload
+// gives up then.
+func (a *agent) reload(ctx context.Context, pollReload chan<- []poller.Collector,
+	reportReload chan<- reporter.Config) {
+	cfg, err := parseFlags()
+	if err != nil {
+		fmt.Printf("[reload] Config is not applied; %s\n", err)
+		return
+	}
+	// Listeners are opened on start only.
+	if cfg.statsdAddr != a.cfg.statsdAddr || cfg.statsdSocket != a.cfg.statsdSocket {
+		fmt.Println("[reload] StatsD listener settings are applied on restart")
+		cfg.statsdAddr, cfg.statsdSocket = a.cfg.statsdAddr, a.cfg.statsdSocket
+	}
+	collectors, reportCfg, err := a.apply(cfg)
+	if err != nil {
+		fmt.Printf("[reload] Config is not applied; %s\n", err)
+		return
+	}
+	select {
+	case pollReload <- collectors:
+	case <-ctx.Done():
+		fmt.Println("[reload] Config is not applied, the agent is stopping")
+		return
+	}
+	select {
+	case reportReload <- reportCfg:
+	case <-ctx.Done():
+		fmt.Println("[reload] Config is not applied, the agent is stopping")
+		return
+	}
+	fmt.Println("[reload] Config is applied")
+}
+
+// watchConfig notifies changed when the config file is modified.
+func watchConfig(ctx context.Context, path string, interval time.Duration, changed chan<- struct{}) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
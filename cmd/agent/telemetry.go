@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/poller"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+// telemetryMetadata describes metrics of the agent itself by name without types.SelfPrefix.
+var telemetryMetadata = map[string]struct {
+	mType string
+	md    types.Metadata
+}{
+	"requests_sent_total":               {repository.Counter, types.Metadata{Description: "Requests accepted by the servers.", Unit: "requests"}},
+	"requests_failed_total":             {repository.Counter, types.Metadata{Description: "Requests failed after all retries.", Unit: "requests"}},
+	"requests_dropped_total":            {repository.Counter, types.Metadata{Description: "Requests dropped because the queue was full.", Unit: "requests"}},
+	"destination_requests_sent_total":   {repository.Counter, types.Metadata{Description: "Requests accepted by the server.", Unit: "requests"}},
+	"destination_requests_failed_total": {repository.Counter, types.Metadata{Description: "Requests failed by the server.", Unit: "requests"}},
+	"destination_healthy":               {repository.Gauge, types.Metadata{Description: "1 if the server is healthy, 0 if it is skipped.", Unit: "bool"}},
+	"bytes_sent_total":                  {repository.Counter, types.Metadata{Description: "Body bytes of requests accepted by the servers.", Unit: "bytes"}},
+	"queue_depth":                       {repository.Gauge, types.Metadata{Description: "Requests waiting for a free sender.", Unit: "requests"}},
+	"request_duration_seconds_bucket":   {repository.Counter, types.Metadata{Description: "Request attempts not slower than le, every retry is a separate attempt.", Unit: "requests"}},
+	"request_duration_seconds_count":    {repository.Counter, types.Metadata{Description: "Request attempts, every retry is a separate attempt.", Unit: "requests"}},
+	"request_duration_seconds_sum":      {repository.Gauge, types.Metadata{Description: "Total duration of request attempts.", Unit: "seconds"}},
+	"polls_total":                       {repository.Counter, types.Metadata{Description: "Polls of the collector.", Unit: "polls"}},
+	"collector_errors_total":            {repository.Counter, types.Metadata{Description: "Polls of the collector which failed.", Unit: "polls"}},
+	"poll_duration_seconds":             {repository.Gauge, types.Metadata{Description: "Duration of the last poll of the collector.", Unit: "seconds"}},
+}
+
+// telemetry records metrics of the agent itself under types.SelfPrefix, so they are reported
+// with the collected ones.
+type telemetry struct {
+	poll   *poller.Stats
+	report *reporter.Stats
+
+	mx sync.Mutex
+	// counters are totals already added to the counters, since the sink takes deltas.
+	counters poller.Counters
+}
+
+func newTelemetry(poll *poller.Stats, report *reporter.Stats) *telemetry {
+	return &telemetry{poll: poll, report: report}
+}
+
+// collector returns the collector which records the metrics every interval.
+func (t *telemetry) collector(interval time.Duration) poller.Collector {
+	return &telemetryCollector{telemetry: t, interval: interval}
+}
+
+func (t *telemetry) record(sink poller.Sink) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	counter := func(name string, labels types.Labels, total int64) {
+		key := types.SeriesKey(types.SelfPrefix+name, labels)
+		if delta := t.counters.Delta(key, uint64(max(total, 0))); delta != 0 {
+			sink.AddCounter(key, types.Counter(delta))
+		}
+	}
+	gauge := func(name string, labels types.Labels, value float64) {
+		sink.SetGauge(types.SeriesKey(types.SelfPrefix+name, labels), types.Gauge(value))
+	}
+
+	r := t.report
+	counter("requests_sent_total", nil, r.Sent())
+	counter("requests_failed_total", nil, r.Failed())
+	counter("requests_dropped_total", nil, r.Dropped())
+	counter("bytes_sent_total", nil, r.BytesSent())
+	gauge("queue_depth", nil, float64(r.QueueDepth()))
+	for _, d := range r.Destinations() {
+		labels := types.Labels{"destination": d.Addr}
+		counter("destination_requests_sent_total", labels, d.Sent)
+		counter("destination_requests_failed_total", labels, d.Failed)
+		var healthy float64
+		if d.Healthy {
+			healthy = 1
+		}
+		gauge("destination_healthy", labels, healthy)
+	}
+
+	latency := r.Latency()
+	for i, count := range latency.Counts {
+		le := "+Inf"
+		if i < len(reporter.LatencyBuckets) {
+			le = strconv.FormatFloat(reporter.LatencyBuckets[i].Seconds(), 'g', -1, 64)
+		}
+		counter("request_duration_seconds_bucket", types.Labels{"le": le}, count)
+	}
+	counter("request_duration_seconds_count", nil, latency.Counts[len(latency.Counts)-1])
+	gauge("request_duration_seconds_sum", nil, latency.Sum.Seconds())
+
+	for _, c := range t.poll.Collectors() {
+		labels := types.Labels{"collector": c.Name}
+		counter("polls_total", labels, c.Polls)
+		counter("collector_errors_total", labels, c.Errors)
+		gauge("poll_duration_seconds", labels, c.Duration.Seconds())
+	}
+
+	for name, m := range telemetryMetadata {
+		md := m.md
+		md.Owner = "agent"
+		sink.Describe(m.mType, types.SelfPrefix+name, md)
+	}
+}
+
+type telemetryCollector struct {
+	*telemetry
+	interval time.Duration
+}
+
+func (c *telemetryCollector) Name() string {
+	return "telemetry"
+}
+
+func (c *telemetryCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *telemetryCollector) Collect(_ context.Context, sink poller.Sink) error {
+	c.record(sink)
+	return nil
+}
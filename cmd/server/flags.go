@@ -2,17 +2,109 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/aggregation"
+	"github.com/ASRafalsky/telemetry/pkg/services/handlers"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
 )
 
-func parseFlags() string {
-	var flagRunAddr string
-	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
-		return envRunAddr
+type config struct {
+	addr       string
+	rateWindow time.Duration
+	names      naming.Policy
+	// gaugeMode is applied to gauges not listed in gaugeModes.
+	gaugeMode  aggregation.Mode
+	gaugeModes map[string]aggregation.Mode
+	avgWindow  time.Duration
+	outOfOrder handlers.OutOfOrderPolicy
+	// key makes the server verify HMAC-SHA256 signatures of requests if it is set.
+	key string
+}
+
+func defaultConfig() config {
+	return config{
+		addr:       ":8080",
+		rateWindow: time.Minute,
+		names:      naming.Lowercase,
+		gaugeMode:  aggregation.Last,
+		avgWindow:  time.Minute,
+		outOfOrder: handlers.DropOutOfOrder,
 	}
+}
+
+func parseFlags() (config, error) {
+	cfg := defaultConfig()
 
-	flag.StringVar(&flagRunAddr, "a", ":8080", "address and port to run server")
+	flag.StringVar(&cfg.addr, "a", cfg.addr, "address and port to run server")
+	flag.DurationVar(&cfg.rateWindow, "w", cfg.rateWindow, "window to compute counter rates over")
+	names := flag.String("n", string(cfg.names), "metric naming policy: preserve, lowercase or prometheus")
+	gaugeModes := flag.String("g", "", "gauge aggregation modes as name=mode list, "+
+		"modes are last, min, max, sum and avg, *=mode sets the default one")
+	flag.DurationVar(&cfg.avgWindow, "avg-window", cfg.avgWindow, "window to average gauges over")
+	outOfOrder := flag.String("o", string(cfg.outOfOrder), "what to do with gauge samples older than the stored ones: "+
+		"drop or reject")
+	flag.StringVar(&cfg.key, "k", cfg.key, "key to verify HMAC-SHA256 signatures of requests")
 	flag.Parse()
 
-	return flagRunAddr
+	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
+		cfg.addr = envRunAddr
+	}
+	if envKey := os.Getenv("KEY"); envKey != "" {
+		cfg.key = envKey
+	}
+
+	var err error
+	if envRateWindow := os.Getenv("RATE_WINDOW"); envRateWindow != "" {
+		if cfg.rateWindow, err = time.ParseDuration(envRateWindow); err != nil {
+			return cfg, fmt.Errorf("invalid RATE_WINDOW %q; %w", envRateWindow, err)
+		}
+	}
+	if cfg.rateWindow <= 0 {
+		return cfg, fmt.Errorf("rate window must be positive, got %v", cfg.rateWindow)
+	}
+
+	if envNames := os.Getenv("NAMING"); envNames != "" {
+		*names = envNames
+	}
+	if cfg.names, err = naming.ParsePolicy(*names); err != nil {
+		return cfg, err
+	}
+
+	if envGaugeModes := os.Getenv("GAUGE_AGGREGATION"); envGaugeModes != "" {
+		*gaugeModes = envGaugeModes
+	}
+	var modes map[string]aggregation.Mode
+	if cfg.gaugeMode, modes, err = aggregation.ParseModes(*gaugeModes); err != nil {
+		return cfg, err
+	}
+	// Names in the modes must match names of the stored metrics.
+	cfg.gaugeModes = make(map[string]aggregation.Mode, len(modes))
+	for name, mode := range modes {
+		key, err := cfg.names.Normalize(name)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid gauge aggregation; %w", err)
+		}
+		cfg.gaugeModes[key] = mode
+	}
+
+	if envAvgWindow := os.Getenv("AVG_WINDOW"); envAvgWindow != "" {
+		if cfg.avgWindow, err = time.ParseDuration(envAvgWindow); err != nil {
+			return cfg, fmt.Errorf("invalid AVG_WINDOW %q; %w", envAvgWindow, err)
+		}
+	}
+	if cfg.avgWindow <= 0 {
+		return cfg, fmt.Errorf("average window must be positive, got %v", cfg.avgWindow)
+	}
+
+	if envOutOfOrder := os.Getenv("OUT_OF_ORDER"); envOutOfOrder != "" {
+		*outOfOrder = envOutOfOrder
+	}
+	if cfg.outOfOrder, err = handlers.ParseOutOfOrderPolicy(*outOfOrder); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
 }
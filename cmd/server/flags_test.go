@@ -2,11 +2,22 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/aggregation"
+	"github.com/ASRafalsky/telemetry/pkg/services/handlers"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
 )
 
 func TestParseFlags_Default(t *testing.T) {
-	addr := parseFlags()
-	require.Equal(t, addr, ":8080")
+	cfg, err := parseFlags()
+	require.NoError(t, err)
+	require.Equal(t, ":8080", cfg.addr)
+	require.Equal(t, time.Minute, cfg.rateWindow)
+	require.Equal(t, naming.Lowercase, cfg.names)
+	require.Equal(t, aggregation.Last, cfg.gaugeMode)
+	require.Empty(t, cfg.gaugeModes)
+	require.Equal(t, handlers.DropOutOfOrder, cfg.outOfOrder)
 }
@@ -8,35 +8,64 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	"github.com/ASRafalsky/telemetry/internal/storage"
+	"github.com/ASRafalsky/telemetry/pkg/services/aggregation"
 	"github.com/ASRafalsky/telemetry/pkg/services/handlers"
+	"github.com/ASRafalsky/telemetry/pkg/services/rates"
 	"github.com/ASRafalsky/telemetry/pkg/services/templates"
 )
 
 func main() {
-	address := parseFlags()
-	fmt.Printf("Server address: %s\n", address)
+	cfg, err := parseFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Server address: %s\n", cfg.addr)
 
-	log.Fatal(http.ListenAndServe(address, newRouter()))
+	log.Fatal(http.ListenAndServe(cfg.addr, newRouter(cfg)))
 }
 
-func newRouter() http.Handler {
-	gaugeRepo := storage.New[string, []byte]()
-	counterRepo := storage.New[string, []byte]()
+func newRouter(cfg config) http.Handler {
+	st := &handlers.Storage{
+		Gauges:      storage.New[string, []byte](),
+		Counters:    storage.New[string, []byte](),
+		Metadata:    storage.New[string, []byte](),
+		Timestamps:  storage.New[string, []byte](),
+		Rates:       rates.New(cfg.rateWindow),
+		Aggregation: aggregation.New(cfg.gaugeMode, cfg.gaugeModes, cfg.avgWindow),
+		OutOfOrder:  cfg.outOfOrder,
+		Names:       cfg.names,
+	}
 
 	r := chi.NewRouter()
+	// Signatures are computed over the body as it is sent, so they are verified before decompression.
+	r.Use(handlers.VerifySignature(cfg.key))
+	r.Use(handlers.Decompress)
 	r.Route("/", func(r chi.Router) {
 		r.Route("/update", func(r chi.Router) {
-			r.Post("/gauge/{name}/{value}", handlers.GaugePostHandler(gaugeRepo))
-			r.Post("/counter/{name}/{value}", handlers.CounterPostHandler(counterRepo))
+			r.Post("/", handlers.UpdateHandler(st))
+			r.Post("/gauge/{name}/{value}", handlers.GaugePostHandler(st))
+			r.Post("/gauge/{name}/{value}/{timestamp}", handlers.GaugePostHandler(st))
+			r.Post("/counter/{name}/{value}", handlers.CounterPostHandler(st))
+			r.Post("/counter/{name}/{value}/{timestamp}", handlers.CounterPostHandler(st))
 			r.Post("/{type}/{name}/{value}", handlers.FailurePostHandler())
+			r.Post("/{type}/{name}/{value}/{timestamp}", handlers.FailurePostHandler())
 		})
+		r.Post("/updates/", handlers.UpdatesHandler(st))
 		r.Route("/value", func(r chi.Router) {
-			r.Get("/gauge/{name}", handlers.GaugeGetHandler(gaugeRepo))
-			r.Get("/counter/{name}", handlers.CounterGetHandler(counterRepo))
+			r.Get("/gauge/{name}", handlers.GaugeGetHandler(st))
+			r.Get("/counter/{name}", handlers.CounterGetHandler(st))
 			r.Get("/{type}/{name}", handlers.FailureGetHandler())
 		})
+		r.Route("/rate", func(r chi.Router) {
+			r.Get("/counter/{name}", handlers.CounterRateHandler(st))
+			r.Get("/{type}/{name}", handlers.FailureGetHandler())
+		})
+		r.Route("/meta", func(r chi.Router) {
+			r.Post("/{type}/{name}", handlers.MetadataPostHandler(st))
+			r.Get("/{type}/{name}", handlers.MetadataGetHandler(st))
+		})
 		r.Post("/", handlers.FailurePostHandler())
-		r.Get("/", handlers.AllGetHandler(templates.PrepareTemplate(), gaugeRepo, counterRepo))
+		r.Get("/", handlers.AllGetHandler(templates.PrepareTemplate(), st))
 	})
 	return r
 }
@@ -1,20 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gojek/heimdall/v7/httpclient"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/aggregation"
+	"github.com/ASRafalsky/telemetry/pkg/services/handlers"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+	"github.com/ASRafalsky/telemetry/pkg/services/signature"
+	"github.com/ASRafalsky/telemetry/pkg/services/sink"
 )
 
 func TestServerStatuses(t *testing.T) {
-	srv := httptest.NewServer(newRouter())
+	srv := httptest.NewServer(newRouter(defaultConfig()))
 	defer srv.Close()
 
 	header := http.Header{
@@ -173,7 +186,7 @@ func TestServerStatuses(t *testing.T) {
 }
 
 func Test_POST_GET(t *testing.T) {
-	srv := httptest.NewServer(newRouter())
+	srv := httptest.NewServer(newRouter(defaultConfig()))
 	defer srv.Close()
 	// Create a new HTTP client with a default timeout
 	timeout := 1000 * time.Millisecond
@@ -238,3 +251,732 @@ func Test_POST_GET(t *testing.T) {
 		require.NoError(t, resp.Body.Close())
 	})
 }
+
+func TestMetadata(t *testing.T) {
+	srv := httptest.NewServer(newRouter(defaultConfig()))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	textHeader := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+	jsonHeader := http.Header{
+		"Content-Type": []string{"application/json"},
+	}
+	md := `{"description":"Cumulative time spent in GC pauses.","unit":"nanoseconds","owner":"agent"}`
+
+	tt := []struct {
+		name          string
+		url           string
+		body          string
+		expStatusCode int
+	}{
+		{
+			name:          "wrong_type",
+			url:           srv.URL + "/meta/wrong_type/PauseTotalNs",
+			body:          md,
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "wrong_body",
+			url:           srv.URL + "/meta/gauge/PauseTotalNs",
+			body:          "lol",
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "empty_param_name",
+			url:           srv.URL + "/meta/gauge/",
+			body:          md,
+			expStatusCode: http.StatusNotFound,
+		},
+		{
+			name:          "correct_metadata",
+			url:           srv.URL + "/meta/gauge/PauseTotalNs",
+			body:          md,
+			expStatusCode: http.StatusOK,
+		},
+	}
+	for _, tc := range tt {
+		t.Run("Post_"+tc.name, func(t *testing.T) {
+			resp, err := client.Post(tc.url, strings.NewReader(tc.body), jsonHeader)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+		})
+	}
+
+	t.Run("Get_metadata", func(t *testing.T) {
+		resp, err := client.Get(srv.URL+"/meta/gauge/PauseTotalNs", textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.JSONEq(t, md, string(buf))
+		require.NoError(t, resp.Body.Close())
+
+		resp, err = client.Get(srv.URL+"/meta/counter/PauseTotalNs", textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	})
+
+	t.Run("Get_value_with_metadata", func(t *testing.T) {
+		resp, err := client.Post(srv.URL+"/update/gauge/PauseTotalNs/100", nil, textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+
+		resp, err = client.Get(srv.URL+"/value/gauge/PauseTotalNs", textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "nanoseconds", resp.Header.Get("X-Metric-Unit"))
+		require.Equal(t, "agent", resp.Header.Get("X-Metric-Owner"))
+		require.NoError(t, resp.Body.Close())
+
+		resp, err = client.Get(srv.URL+"/", textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		for _, key := range []string{"pausetotalns", "nanoseconds", "Cumulative time spent in GC pauses."} {
+			assert.Contains(t, string(buf), key)
+		}
+		require.NoError(t, resp.Body.Close())
+	})
+}
+
+func TestLabels(t *testing.T) {
+	srv := httptest.NewServer(newRouter(defaultConfig()))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	textHeader := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+	jsonHeader := http.Header{
+		"Content-Type": []string{"application/json"},
+	}
+
+	tt := []struct {
+		name          string
+		url           string
+		body          string
+		expStatusCode int
+	}{
+		{
+			name:          "url_labels",
+			url:           "/update/gauge/ProcessRSS/10?process=nginx&pid=1",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "json_labels",
+			url:           "/updates/",
+			body:          `[{"id":"ProcessRSS","type":"gauge","value":20,"labels":{"process":"redis","pid":"2"}}]`,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "invalid_url_label",
+			url:           "/update/gauge/ProcessRSS/10?2pid=1",
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "duplicated_url_label",
+			url:           "/update/gauge/ProcessRSS/10?pid=1&pid=2",
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "invalid_json_label",
+			url:           "/update/",
+			body:          `{"id":"ProcessRSS","type":"gauge","value":20,"labels":{"process-name":"redis"}}`,
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "metadata",
+			url:           "/meta/gauge/ProcessRSS",
+			body:          `{"unit":"bytes"}`,
+			expStatusCode: http.StatusOK,
+		},
+	}
+	for _, tc := range tt {
+		t.Run("Post_"+tc.name, func(t *testing.T) {
+			resp, err := client.Post(srv.URL+tc.url, strings.NewReader(tc.body), jsonHeader)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+		})
+	}
+
+	// Series are stored separately and share metadata of the metric. A series is found by a part of its labels
+	// if no other series has them, otherwise the matching series are listed.
+	for _, tc := range []struct {
+		url           string
+		expStatusCode int
+		expData       string
+	}{
+		{url: "/value/gauge/ProcessRSS?process=nginx&pid=1", expStatusCode: http.StatusOK, expData: "10"},
+		{url: "/value/gauge/ProcessRSS?pid=2&process=redis", expStatusCode: http.StatusOK, expData: "20"},
+		{url: "/value/gauge/ProcessRSS?pid=1", expStatusCode: http.StatusOK, expData: "10"},
+		{url: "/value/gauge/ProcessRSS?pid=3", expStatusCode: http.StatusNotFound},
+		{
+			url:           "/value/gauge/ProcessRSS",
+			expStatusCode: http.StatusConflict,
+			expData: "several series match, select one by labels:\n" +
+				`processrss{pid="1",process="nginx"}` + "\n" + `processrss{pid="2",process="redis"}` + "\n",
+		},
+	} {
+		resp, err := client.Get(srv.URL+tc.url, textHeader)
+		require.NoError(t, err)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, tc.expStatusCode, resp.StatusCode, tc.url)
+		require.Equal(t, tc.expData, string(buf), tc.url)
+		if tc.expStatusCode == http.StatusOK {
+			require.Equal(t, "bytes", resp.Header.Get("X-Metric-Unit"))
+		}
+	}
+
+	resp, err := client.Get(srv.URL+"/", textHeader)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	for _, key := range []string{"pid=&#34;1&#34;,process=&#34;nginx&#34;", "pid=&#34;2&#34;,process=&#34;redis&#34;"} {
+		assert.Contains(t, string(buf), key)
+	}
+}
+
+func TestAgentIdentity(t *testing.T) {
+	srv := httptest.NewServer(newRouter(defaultConfig()))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	// report sends the final report of the agent with the options like the agent does.
+	report := func(alloc float64, opts ...reporter.Option) {
+		repos := repository.NewRepositories()
+		sink.New(repos).SetGauge("Alloc", types.Gauge(alloc))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		opts = append(opts, reporter.WithFinalReport(time.Second))
+		require.NoError(t, reporter.Send(ctx, srv.URL, time.Hour, client, repos, opts...))
+	}
+	// Series of agents are labelled by their instance IDs, the only one is read without labels.
+	report(1, reporter.WithSourceID("node1"), reporter.WithLabels(types.Labels{"instance_id": "node1"}))
+	resp, err := client.Get(srv.URL+"/value/gauge/Alloc", nil)
+	require.NoError(t, err)
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", string(buf))
+
+	// With several agents the series is selected by the instance ID.
+	report(2, reporter.WithSourceID("node2"), reporter.WithLabels(types.Labels{"instance_id": "node2"}))
+	resp, err = client.Get(srv.URL+"/value/gauge/Alloc", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	for url, expData := range map[string]string{
+		"/value/gauge/Alloc?instance_id=node1": "1",
+		"/value/gauge/Alloc?instance_id=node2": "2",
+	} {
+		resp, err := client.Get(srv.URL+url, nil)
+		require.NoError(t, err)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode, url)
+		require.Equal(t, expData, string(buf), url)
+	}
+}
+
+func TestCounterRate(t *testing.T) {
+	srv := httptest.NewServer(newRouter(defaultConfig()))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	header := http.Header{
+		"Content-Type": []string{"text/plain"},
+		"X-Source-ID":  []string{"agent1"},
+	}
+
+	resp, err := client.Get(srv.URL+"/rate/counter/PollCount", header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = client.Get(srv.URL+"/rate/gauge/PollCount", header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	require.NoError(t, resp.Body.Close())
+
+	for i, value := range []string{"0", "10", "5"} {
+		if i > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		resp, err = client.Post(srv.URL+"/update/counter/PollCount/"+value, nil, header)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	resp, err = client.Get(srv.URL+"/rate/counter/PollCount", header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("X-Counter-Resets"))
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	rate, err := strconv.ParseFloat(string(buf), 64)
+	require.NoError(t, err)
+	// Reset is detected, so counter grows by 15 and the rate is positive.
+	require.Positive(t, rate)
+	require.NoError(t, resp.Body.Close())
+
+	// Decreasing deltas are not resets.
+	header.Set("X-Counter-Mode", "delta")
+	for _, value := range []string{"10", "5"} {
+		resp, err = client.Post(srv.URL+"/update/counter/Deltas/"+value, nil, header)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	}
+	resp, err = client.Get(srv.URL+"/rate/counter/Deltas", header)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0", resp.Header.Get("X-Counter-Resets"))
+	require.NoError(t, resp.Body.Close())
+
+	resp, err = client.Get(srv.URL+"/value/counter/Deltas", header)
+	require.NoError(t, err)
+	buf, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "15", string(buf))
+	require.NoError(t, resp.Body.Close())
+}
+
+func TestNamingPolicy(t *testing.T) {
+	header := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	tt := []struct {
+		name          string
+		policy        naming.Policy
+		postName      string
+		getName       string
+		expStatusCode int
+	}{
+		{
+			name:          "lowercase",
+			policy:        naming.Lowercase,
+			postName:      "PollCount",
+			getName:       "pollcount",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "preserve",
+			policy:        naming.Preserve,
+			postName:      "PollCount",
+			getName:       "PollCount",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "preserve_case_sensitive",
+			policy:        naming.Preserve,
+			postName:      "PollCount",
+			getName:       "pollcount",
+			expStatusCode: http.StatusNotFound,
+		},
+		{
+			name:          "prometheus",
+			policy:        naming.Prometheus,
+			postName:      "go.gc-count",
+			getName:       "go_gc_count",
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "prometheus_same_on_read",
+			policy:        naming.Prometheus,
+			postName:      "go.gc-count",
+			getName:       "go-gc.count",
+			expStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.names = tc.policy
+			srv := httptest.NewServer(newRouter(cfg))
+			defer srv.Close()
+
+			for _, mType := range []string{"gauge", "counter"} {
+				resp, err := client.Post(srv.URL+"/update/"+mType+"/"+tc.postName+"/1", nil, header)
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.NoError(t, resp.Body.Close())
+
+				resp, err = client.Get(srv.URL+"/value/"+mType+"/"+tc.getName, header)
+				require.NoError(t, err)
+				require.Equal(t, tc.expStatusCode, resp.StatusCode)
+				require.NoError(t, resp.Body.Close())
+			}
+		})
+	}
+
+	t.Run("invalid_name", func(t *testing.T) {
+		srv := httptest.NewServer(newRouter(defaultConfig()))
+		defer srv.Close()
+
+		resp, err := client.Post(srv.URL+"/update/gauge/"+strings.Repeat("a", naming.MaxLength+1)+"/1", nil, header)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(buf), naming.ErrInvalidName.Error())
+		require.NoError(t, resp.Body.Close())
+
+		resp, err = client.Get(srv.URL+"/value/counter/poll%20count", header)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	})
+}
+
+func TestGaugeAggregation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.gaugeModes = map[string]aggregation.Mode{
+		"min": aggregation.Min,
+		"max": aggregation.Max,
+		"sum": aggregation.Sum,
+		"avg": aggregation.Average,
+	}
+	srv := httptest.NewServer(newRouter(cfg))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	header := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+
+	tt := []struct {
+		name    string
+		expMode string
+		expData string
+	}{
+		{
+			name:    "last",
+			expMode: "last",
+			expData: "2",
+		},
+		{
+			name:    "min",
+			expMode: "min",
+			expData: "1",
+		},
+		{
+			name:    "max",
+			expMode: "max",
+			expData: "4",
+		},
+		{
+			name:    "sum",
+			expMode: "sum",
+			expData: "7",
+		},
+		{
+			name:    "avg",
+			expMode: "avg",
+			expData: "2.3333333333333335",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, value := range []string{"1", "4", "2"} {
+				resp, err := client.Post(srv.URL+"/update/gauge/"+tc.name+"/"+value, nil, header)
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.NoError(t, resp.Body.Close())
+			}
+
+			resp, err := client.Get(srv.URL+"/value/gauge/"+tc.name, header)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, tc.expMode, resp.Header.Get("X-Gauge-Aggregation"))
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tc.expData, string(buf))
+			require.NoError(t, resp.Body.Close())
+		})
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+	textHeader := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+	jsonHeader := http.Header{
+		"Content-Type": []string{"application/json"},
+	}
+	now := time.Now()
+	older := strconv.FormatInt(now.Add(-time.Minute).UnixMilli(), 10)
+	newer := now.Add(time.Minute).Format(time.RFC3339)
+
+	getGauge := func(t *testing.T, url string) (string, string) {
+		resp, err := client.Get(url+"/value/gauge/load", textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(buf), resp.Header.Get("X-Metric-Timestamp")
+	}
+
+	tt := []struct {
+		name          string
+		policy        handlers.OutOfOrderPolicy
+		expStatusCode int
+		// expCounter is the counter after the batch with the out of order sample.
+		expCounter string
+	}{
+		{
+			name:          "drop",
+			policy:        handlers.DropOutOfOrder,
+			expStatusCode: http.StatusOK,
+			expCounter:    "20",
+		},
+		{
+			name:          "reject",
+			policy:        handlers.RejectOutOfOrder,
+			expStatusCode: http.StatusConflict,
+			expCounter:    "15",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.outOfOrder = tc.policy
+			srv := httptest.NewServer(newRouter(cfg))
+			defer srv.Close()
+
+			// Server receive time is used without timestamp.
+			resp, err := client.Post(srv.URL+"/update/gauge/load/1", nil, textHeader)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+			value, ts := getGauge(t, srv.URL)
+			require.Equal(t, "1", value)
+			stored, err := time.Parse(time.RFC3339Nano, ts)
+			require.NoError(t, err)
+			require.WithinDuration(t, now, stored, 10*time.Second)
+
+			resp, err = client.Post(srv.URL+"/update/gauge/load/2/"+older, nil, textHeader)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+			value, _ = getGauge(t, srv.URL)
+			require.Equal(t, "1", value)
+
+			resp, err = client.Post(srv.URL+"/update/gauge/load/3/"+newer, nil, textHeader)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+			value, ts = getGauge(t, srv.URL)
+			require.Equal(t, "3", value)
+			stored, err = time.Parse(time.RFC3339Nano, ts)
+			require.NoError(t, err)
+			require.Equal(t, newer, stored.Format(time.RFC3339))
+
+			body := `{"id":"load","type":"gauge","value":4,"timestamp":` + older + `}`
+			resp, err = client.Post(srv.URL+"/update/", strings.NewReader(body), jsonHeader)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"id":"load","type":"gauge","value":3,"timestamp":`+
+				strconv.FormatInt(stored.UnixMilli(), 10)+`}`, string(buf))
+			require.NoError(t, resp.Body.Close())
+
+			// Late counter samples are still counted.
+			for _, ts := range []string{newer, older} {
+				resp, err = client.Post(srv.URL+"/update/counter/requests/5/"+ts, nil, textHeader)
+				require.NoError(t, err)
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.NoError(t, resp.Body.Close())
+			}
+			body = `{"id":"requests","type":"counter","delta":5}`
+			resp, err = client.Post(srv.URL+"/update/", strings.NewReader(body), jsonHeader)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			buf, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"id":"requests","type":"counter","delta":15,"timestamp":`+
+				strconv.FormatInt(stored.UnixMilli(), 10)+`}`, string(buf))
+			require.NoError(t, resp.Body.Close())
+
+			// The batch with an out of order sample is rejected as a whole, so it may be sent again.
+			body = `[{"id":"requests","type":"counter","delta":5},{"id":"load","type":"gauge","value":5,"timestamp":` +
+				older + `}]`
+			resp, err = client.Post(srv.URL+"/updates/", strings.NewReader(body), jsonHeader)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+			value, _ = getGauge(t, srv.URL)
+			require.Equal(t, "3", value)
+			resp, err = client.Get(srv.URL+"/value/counter/requests", textHeader)
+			require.NoError(t, err)
+			buf, err = io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, tc.expCounter, string(buf))
+		})
+	}
+
+	t.Run("wrong_timestamp", func(t *testing.T) {
+		srv := httptest.NewServer(newRouter(defaultConfig()))
+		defer srv.Close()
+
+		resp, err := client.Post(srv.URL+"/update/gauge/load/1/lol", nil, textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+
+		resp, err = client.Post(srv.URL+"/update/", strings.NewReader(`{"id":"load","type":"gauge"}`), jsonHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.NoError(t, resp.Body.Close())
+	})
+}
+
+func TestUpdates(t *testing.T) {
+	srv := httptest.NewServer(newRouter(defaultConfig()))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	textHeader := http.Header{
+		"Content-Type": []string{"text/plain"},
+	}
+
+	compress := func(t *testing.T, data string) io.Reader {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(data))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return &buf
+	}
+
+	tt := []struct {
+		name          string
+		body          string
+		gzip          bool
+		expStatusCode int
+	}{
+		{
+			name:          "wrong_body",
+			body:          `{"id":"load","type":"gauge","value":1}`,
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "wrong_metric",
+			body:          `[{"id":"load","type":"gauge","value":1},{"id":"requests","type":"counter"}]`,
+			expStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:          "plain",
+			body:          `[{"id":"load","type":"gauge","value":1},{"id":"requests","type":"counter","delta":2}]`,
+			expStatusCode: http.StatusOK,
+		},
+		{
+			name:          "gzip",
+			body:          `[{"id":"load","type":"gauge","value":3},{"id":"requests","type":"counter","delta":2}]`,
+			gzip:          true,
+			expStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{
+				"Content-Type": []string{"application/json"},
+			}
+			body := io.Reader(strings.NewReader(tc.body))
+			if tc.gzip {
+				header.Set("Content-Encoding", "gzip")
+				body = compress(t, tc.body)
+			}
+			resp, err := client.Post(srv.URL+"/updates/", body, header)
+			require.NoError(t, err)
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+			require.NoError(t, resp.Body.Close())
+		})
+	}
+
+	// Only valid batches are applied.
+	for url, expData := range map[string]string{
+		"/value/gauge/load":       "3",
+		"/value/counter/requests": "4",
+	} {
+		resp, err := client.Get(srv.URL+url, textHeader)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		buf, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, expData, string(buf))
+		require.NoError(t, resp.Body.Close())
+	}
+}
+
+func TestSignature(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.key = "secret"
+	srv := httptest.NewServer(newRouter(cfg))
+	defer srv.Close()
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+
+	body := `[{"id":"load","type":"gauge","value":1}]`
+	tt := []struct {
+		name          string
+		sig           string
+		expStatusCode int
+	}{
+		{name: "valid", sig: signature.Sign("secret", []byte(body)), expStatusCode: http.StatusOK},
+		{name: "wrong_key", sig: signature.Sign("other", []byte(body)), expStatusCode: http.StatusBadRequest},
+		{name: "missing", expStatusCode: http.StatusBadRequest},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{"Content-Type": []string{"application/json"}}
+			if tc.sig != "" {
+				header.Set(signature.Header, tc.sig)
+			}
+			resp, err := client.Post(srv.URL+"/updates/", strings.NewReader(body), header)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			require.Equal(t, tc.expStatusCode, resp.StatusCode)
+		})
+	}
+
+	// Bodies are read up to the limit.
+	large := strings.Repeat(" ", handlers.MaxSignedBodySize+1)
+	header := http.Header{
+		"Content-Type":   []string{"application/json"},
+		signature.Header: []string{signature.Sign("secret", []byte(large))},
+	}
+	resp, err := client.Post(srv.URL+"/updates/", strings.NewReader(large), header)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Reads are not signed.
+	resp, err = client.Get(srv.URL+"/value/gauge/load", nil)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -39,6 +39,19 @@ func (m *MemStorage[K, V]) Get(k K) (V, bool) {
 	return v, false
 }
 
+// Update sets value returned by fn with key and returns it. Fn gets the previous value and true
+// if it exists, or empty value and false. The whole storage is write-locked while fn is running, so fn must be
+// short and must not call methods of the storage.
+func (m *MemStorage[K, V]) Update(k K, fn func(v V, ok bool) V) V {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	v, ok := m.storage[k]
+	v = fn(v, ok)
+	m.storage[k] = v
+	return v
+}
+
 // Delete deletes entry by the key.
 func (m *MemStorage[K, V]) Delete(k K) {
 	m.mx.Lock()
@@ -49,12 +62,18 @@ func (m *MemStorage[K, V]) Delete(k K) {
 
 // Size returns number of items in the MemStorage.
 func (m *MemStorage[K, V]) Size() int {
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+
 	return len(m.storage)
 }
 
+// ForEach calls fn for every entry until fn returns an error or ctx is done. The storage is read-locked while
+// ForEach is running: readers are not blocked, but fn must not call methods of the storage, since a waiting
+// writer blocks them until ForEach returns.
 func (m *MemStorage[K, V]) ForEach(ctx context.Context, fn func(k K, v V) error) error {
-	m.mx.Lock()
-	defer m.mx.Unlock()
+	m.mx.RLock()
+	defer m.mx.RUnlock()
 
 	for k, v := range m.storage {
 		if ctx.Err() != nil {
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -62,3 +63,26 @@ func TestMemStorage(t *testing.T) {
 	_, ok := ms.Get(0)
 	require.False(t, ok)
 }
+
+func TestMemStorage_Update(t *testing.T) {
+	ms := New[string, int]()
+
+	var wg sync.WaitGroup
+	for range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ms.Update("key", func(v int, ok bool) int {
+				if !ok {
+					return 1
+				}
+				return v + 1
+			})
+		}()
+	}
+	wg.Wait()
+
+	v, ok := ms.Get("key")
+	require.True(t, ok)
+	require.Equal(t, 100, v)
+}
@@ -0,0 +1,103 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels distinguish series of the same metric, e.g. of different processes.
+type Labels map[string]string
+
+var errInvalidSeriesKey = errors.New("invalid series key")
+
+// SeriesKey returns key of the metric series: the name followed by the labels sorted by name,
+// e.g. ProcessRSS{pid="42",process="nginx"}. It is the name if there are no labels.
+func SeriesKey(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + labels.String() + "}"
+}
+
+// SeriesName returns the metric name of the series key.
+func SeriesName(key string) string {
+	name, _, _ := strings.Cut(key, "{")
+	return name
+}
+
+// ParseSeriesKey returns the metric name and labels of the series key.
+func ParseSeriesKey(key string) (string, Labels, error) {
+	name, rest, ok := strings.Cut(key, "{")
+	if !ok {
+		return key, nil, nil
+	}
+	rest, ok = strings.CutSuffix(rest, "}")
+	if !ok {
+		return "", nil, fmt.Errorf("%w %q: missing closing brace", errInvalidSeriesKey, key)
+	}
+
+	labels := make(Labels)
+	for rest != "" {
+		var label string
+		label, rest, ok = strings.Cut(rest, `="`)
+		if !ok {
+			return "", nil, fmt.Errorf("%w %q: missing label value", errInvalidSeriesKey, key)
+		}
+		var value strings.Builder
+		escaped, closed := false, false
+		for i, r := range rest {
+			switch {
+			case escaped:
+				if r == 'n' {
+					r = '\n'
+				}
+				value.WriteRune(r)
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				rest, closed = rest[i+1:], true
+			default:
+				value.WriteRune(r)
+			}
+			if closed {
+				break
+			}
+		}
+		if !closed {
+			return "", nil, fmt.Errorf("%w %q: unterminated label value", errInvalidSeriesKey, key)
+		}
+		labels[strings.TrimSpace(label)] = value.String()
+		rest = strings.TrimSpace(strings.TrimPrefix(rest, ","))
+	}
+	return name, labels, nil
+}
+
+// String returns labels sorted by name as name="value" pairs separated by commas.
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabelValue(l[name]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
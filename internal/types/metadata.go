@@ -0,0 +1,42 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Metadata describes what a metric measures, its unit and who owns it.
+type Metadata struct {
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// MetadataToBytes returns Metadata as JSON encoded byte slice.
+func MetadataToBytes(m Metadata) []byte {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		fmt.Println("failed to marshal metadata: ", err)
+		return nil
+	}
+	return buf
+}
+
+// BytesToMetadata converts JSON encoded byte slice to Metadata, it returns zero value for bad data.
+func BytesToMetadata(b []byte) Metadata {
+	m, err := ParseMetadata(b)
+	if err != nil {
+		return Metadata{}
+	}
+	return m
+}
+
+// ParseMetadata returns Metadata from JSON encoded byte slice if it parsed without error
+// else it returns zero value with error.
+func ParseMetadata(b []byte) (Metadata, error) {
+	var m Metadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return Metadata{}, err
+	}
+	return m, nil
+}
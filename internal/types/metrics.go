@@ -0,0 +1,50 @@
+package types
+
+import (
+	"strconv"
+	"time"
+)
+
+// Metrics is JSON representation of the metric update.
+type Metrics struct {
+	ID    string   `json:"id"`              // metric name
+	MType string   `json:"type"`            // gauge or counter
+	Delta *int64   `json:"delta,omitempty"` // counter value
+	Value *float64 `json:"value,omitempty"` // gauge value
+	// Labels distinguish series of the metric, e.g. of different processes.
+	Labels Labels `json:"labels,omitempty"`
+	// Timestamp is Unix time of the sample in milliseconds, zero means the server receive time.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// SelfPrefix is reserved for metrics of the agent itself, metrics received from other sources can't use it.
+const SelfPrefix = "__agent_"
+
+// SourceIDHeader identifies the agent which has sent the request.
+const SourceIDHeader = "X-Source-ID"
+
+const (
+	// CounterModeHeader tells the server how counter values of the request are reported.
+	CounterModeHeader = "X-Counter-Mode"
+	// CounterModeDelta means counter values are increments since the previous report of the source,
+	// otherwise they are cumulative values of the source.
+	CounterModeDelta = "delta"
+)
+
+// ParseTimestamp returns time from Unix time in milliseconds or RFC 3339 string.
+func ParseTimestamp(in string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(in, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, in)
+}
+
+// TimeToBytes returns time as LE byte slice of Unix time in nanoseconds.
+func TimeToBytes(t time.Time) []byte {
+	return CounterToBytes(Counter(t.UnixNano()))
+}
+
+// BytesToTime converts LE byte slice of Unix time in nanoseconds to time.
+func BytesToTime(b []byte) time.Time {
+	return time.Unix(0, int64(BytesToCounter(b)))
+}
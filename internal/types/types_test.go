@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -126,3 +127,92 @@ func TestBytesToTypeWithBadData(t *testing.T) {
 		})
 	}
 }
+
+func TestMetadata(t *testing.T) {
+	md := Metadata{
+		Description: "Number of completed GC cycles.",
+		Unit:        "cycles",
+		Owner:       "agent",
+	}
+	require.Equal(t, md, BytesToMetadata(MetadataToBytes(md)))
+	require.Equal(t, Metadata{}, BytesToMetadata(MetadataToBytes(Metadata{})))
+
+	_, err := ParseMetadata([]byte("lol"))
+	require.Error(t, err)
+	assert.NotPanics(t, func() {
+		require.Equal(t, Metadata{}, BytesToMetadata(nil))
+	})
+}
+
+func TestTimestamp(t *testing.T) {
+	ts := time.UnixMilli(1700000000123)
+
+	tt := []struct {
+		in  string
+		err bool
+	}{
+		{
+			in: "1700000000123",
+		},
+		{
+			in: ts.UTC().Format(time.RFC3339Nano),
+		},
+		{
+			in: ts.Format(time.RFC3339Nano),
+		},
+		{
+			in:  "lol",
+			err: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.in, func(t *testing.T) {
+			parsed, err := ParseTimestamp(tc.in)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, ts.Equal(parsed))
+			require.True(t, ts.Equal(BytesToTime(TimeToBytes(parsed))))
+		})
+	}
+}
+
+func TestSeriesKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels Labels
+		key    string
+	}{
+		{name: "no_labels", metric: "Alloc", key: "Alloc"},
+		{name: "sorted", metric: "ProcessRSS", labels: Labels{"process": "nginx", "pid": "42"},
+			key: `ProcessRSS{pid="42",process="nginx"}`},
+		{name: "escaped", metric: "Requests", labels: Labels{"path": `a"b\c` + "\n"},
+			key: `Requests{path="a\"b\\c\n"}`},
+		{name: "empty_value", metric: "Requests", labels: Labels{"path": ""}, key: `Requests{path=""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := SeriesKey(tt.metric, tt.labels)
+			require.Equal(t, tt.key, key)
+			require.Equal(t, tt.metric, SeriesName(key))
+
+			name, labels, err := ParseSeriesKey(key)
+			require.NoError(t, err)
+			require.Equal(t, tt.metric, name)
+			if len(tt.labels) == 0 {
+				require.Empty(t, labels)
+			} else {
+				require.Equal(t, tt.labels, labels)
+			}
+		})
+	}
+
+	for _, key := range []string{`Requests{path="a"`, `Requests{path}`, `Requests{path="a}`} {
+		_, _, err := ParseSeriesKey(key)
+		require.Error(t, err, key)
+	}
+}
@@ -0,0 +1,150 @@
+// Package client pushes metrics of an application to the server without running the agent.
+// Values are buffered in memory and flushed in JSON batches every interval by the agent reporter,
+// so the client uses the same wire format, retries and request signing.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
+	"github.com/ASRafalsky/telemetry/pkg/services/reporter"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+	"github.com/ASRafalsky/telemetry/pkg/services/sink"
+)
+
+// Client buffers values of gauges and counters and flushes them to the server until it is closed.
+// It is safe for concurrent use.
+type Client struct {
+	sink   sink.Sink
+	cancel context.CancelFunc
+	done   chan error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New starts the client which sends metrics to the server at addr, e.g. localhost:8080 or
+// https://metrics.example.com.
+func New(addr string, opts ...Option) (*Client, error) {
+	o := newOptions(opts...)
+	switch {
+	case addr == "":
+		return nil, errors.New("server address is required")
+	case o.interval <= 0:
+		return nil, fmt.Errorf("interval must be positive, got %v", o.interval)
+	case o.closeTimeout < 0:
+		return nil, fmt.Errorf("close timeout must not be negative, got %v", o.closeTimeout)
+	case o.batchSize < 0:
+		return nil, fmt.Errorf("batch size must not be negative, got %d", o.batchSize)
+	}
+	for i, d := range o.retries {
+		if d < 0 {
+			return nil, fmt.Errorf("retries[%d] must not be negative, got %v", i, d)
+		}
+	}
+	if err := naming.ValidateLabels(o.labels); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	ropts := []reporter.Option{
+		reporter.WithBatch(o.batchSize),
+		reporter.WithRetries(o.retries...),
+		reporter.WithFinalReport(o.closeTimeout),
+		reporter.WithLabels(o.labels),
+		reporter.WithLogger(o.logger),
+	}
+	if o.gzip {
+		ropts = append(ropts, reporter.WithGzip())
+	}
+	if o.key != "" {
+		ropts = append(ropts, reporter.WithKey(o.key))
+	}
+	if o.sourceID != "" {
+		ropts = append(ropts, reporter.WithSourceID(o.sourceID))
+	}
+
+	repos := repository.NewRepositories()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{sink: sink.New(repos), cancel: cancel, done: make(chan error, 1)}
+	go func() {
+		c.done <- reporter.Send(ctx, strings.TrimSuffix(addr, "/"), o.interval, o.httpClient, repos, ropts...)
+	}()
+	return c, nil
+}
+
+// Close flushes the buffered values and stops the client. It waits for them at most the close timeout
+// and returns an error if they are not delivered. Values recorded after Close are not sent.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.closeErr = <-c.done
+	})
+	return c.closeErr
+}
+
+// Gauge is a metric which keeps the last value set, e.g. the size of a queue.
+type Gauge struct {
+	sink sink.Sink
+	key  string
+}
+
+// Gauge returns the handle of the gauge series with the name and labels.
+func (c *Client) Gauge(name string, labels map[string]string) (*Gauge, error) {
+	key, err := seriesKey(name, labels)
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{sink: c.sink, key: key}, nil
+}
+
+// Set sets the value reported on the next flush.
+func (g *Gauge) Set(value float64) {
+	g.sink.SetGauge(g.key, types.Gauge(value))
+}
+
+// Counter is a metric which sums increments, e.g. the number of handled requests.
+type Counter struct {
+	sink sink.Sink
+	key  string
+}
+
+// Counter returns the handle of the counter series with the name and labels.
+func (c *Client) Counter(name string, labels map[string]string) (*Counter, error) {
+	key, err := seriesKey(name, labels)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{sink: c.sink, key: key}, nil
+}
+
+// Add adds delta to the counter. Increments are summed locally until the server acknowledges them.
+func (c *Counter) Add(delta int64) {
+	c.sink.AddCounter(c.key, types.Counter(delta))
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// seriesKey validates the metric name and labels like the server does and returns the series key.
+func seriesKey(name string, labels map[string]string) (string, error) {
+	if _, err := naming.Preserve.Normalize(name); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(name, types.SelfPrefix) {
+		return "", fmt.Errorf("%w: prefix %s is reserved for the agent", naming.ErrInvalidName, types.SelfPrefix)
+	}
+	if err := naming.ValidateLabels(labels); err != nil {
+		return "", err
+	}
+	return types.SeriesKey(name, labels), nil
+}
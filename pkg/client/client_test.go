@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/signature"
+)
+
+// testServer records metrics of the received batches and responds with 500 to the first failures requests.
+type testServer struct {
+	t        *testing.T
+	failures atomic.Int32
+	mx       sync.Mutex
+	metrics  []types.Metrics
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.failures.Add(-1) >= 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	assert.Equal(s.t, "/updates/", r.URL.Path)
+	assert.Equal(s.t, types.CounterModeDelta, r.Header.Get(types.CounterModeHeader))
+
+	data, err := io.ReadAll(r.Body)
+	require.NoError(s.t, err)
+	// The signature covers the body as it is sent.
+	if sig := r.Header.Get(signature.Header); sig != "" {
+		assert.True(s.t, signature.Verify("secret", data, sig))
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		require.NoError(s.t, err)
+		data, err = io.ReadAll(gz)
+		require.NoError(s.t, err)
+	}
+	var metrics []types.Metrics
+	require.NoError(s.t, json.Unmarshal(data, &metrics))
+
+	s.mx.Lock()
+	s.metrics = append(s.metrics, metrics...)
+	s.mx.Unlock()
+}
+
+func (s *testServer) received() map[string]types.Metrics {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	received := make(map[string]types.Metrics)
+	for _, m := range s.metrics {
+		key := types.SeriesKey(m.ID, m.Labels)
+		if prev, ok := received[key]; ok && m.Delta != nil {
+			*m.Delta += *prev.Delta
+		}
+		received[key] = m
+	}
+	return received
+}
+
+// logBuffer collects the log written by the reporter goroutines.
+type logBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestClient(t *testing.T) {
+	s := &testServer{t: t}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithInterval(time.Hour), WithGzip(), WithKey("secret"),
+		WithLabels(map[string]string{"service": "api", "env": "test"}))
+	require.NoError(t, err)
+
+	queue, err := c.Gauge("queue_size", nil)
+	require.NoError(t, err)
+	requests, err := c.Counter("requests", map[string]string{"env": "prod"})
+	require.NoError(t, err)
+	queue.Set(1)
+	queue.Set(7)
+	requests.Add(2)
+	requests.Inc()
+
+	// Buffered values are flushed on Close.
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close())
+
+	received := s.received()
+	require.Len(t, received, 2)
+	g := received[types.SeriesKey("queue_size", types.Labels{"service": "api", "env": "test"})]
+	require.NotNil(t, g.Value)
+	assert.Equal(t, 7.0, *g.Value)
+	// Labels of the series take precedence over the client ones.
+	cnt := received[types.SeriesKey("requests", types.Labels{"service": "api", "env": "prod"})]
+	require.NotNil(t, cnt.Delta)
+	assert.Equal(t, int64(3), *cnt.Delta)
+}
+
+func TestClientFlush(t *testing.T) {
+	s := &testServer{t: t}
+	s.failures.Store(1)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	log := &logBuffer{}
+	c, err := New(srv.URL, WithInterval(10*time.Millisecond), WithRetries(time.Millisecond), WithLogger(log))
+	require.NoError(t, err)
+	hits, err := c.Counter("hits", nil)
+	require.NoError(t, err)
+	hits.Add(5)
+
+	// Failed requests are retried, delivered increments are not sent again.
+	require.Eventually(t, func() bool {
+		m, ok := s.received()["hits"]
+		return ok && *m.Delta == 5
+	}, time.Second, 5*time.Millisecond)
+	hits.Inc()
+	require.NoError(t, c.Close())
+	assert.Equal(t, int64(6), *s.received()["hits"].Delta)
+	// The log goes to the logger instead of stdout.
+	assert.Contains(t, log.String(), "Attempt 1 to "+srv.URL+"/updates/ failed")
+}
+
+func TestClientErrors(t *testing.T) {
+	_, err := New("")
+	require.Error(t, err)
+	_, err = New("localhost:8080", WithInterval(0))
+	require.Error(t, err)
+	_, err = New("localhost:8080", WithRetries(-time.Second))
+	require.Error(t, err)
+	_, err = New("localhost:8080", WithLabels(map[string]string{"1x": "y"}))
+	require.Error(t, err)
+
+	c, err := New("localhost:8080", WithCloseTimeout(0))
+	require.NoError(t, err)
+	for _, name := range []string{"", "bad name", types.SelfPrefix + "x"} {
+		_, err = c.Gauge(name, nil)
+		assert.Error(t, err, name)
+		_, err = c.Counter(name, nil)
+		assert.Error(t, err, name)
+	}
+	_, err = c.Counter("ok", map[string]string{"bad-label": "x"})
+	assert.Error(t, err)
+	require.NoError(t, c.Close())
+
+	// Values which are not delivered are reported by Close.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	c, err = New(srv.URL, WithInterval(time.Hour), WithCloseTimeout(time.Second))
+	require.NoError(t, err)
+	g, err := c.Gauge("temperature", nil)
+	require.NoError(t, err)
+	g.Set(21.5)
+	require.Error(t, c.Close())
+}
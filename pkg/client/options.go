@@ -0,0 +1,123 @@
+package client
+
+import (
+	"io"
+	"maps"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+)
+
+// Option configures the client.
+type Option func(*options)
+
+type options struct {
+	interval time.Duration
+	// closeTimeout limits the final report sent by Close, zero means buffered values are dropped.
+	closeTimeout time.Duration
+	httpClient   *httpclient.Client
+	batchSize    int
+	gzip         bool
+	retries      []time.Duration
+	// key signs requests if it is set.
+	key      string
+	labels   map[string]string
+	sourceID string
+	// logger receives the log of the reporter, it is discarded by default.
+	logger io.Writer
+}
+
+const (
+	defaultInterval     = 10 * time.Second
+	defaultCloseTimeout = 5 * time.Second
+	defaultHTTPTimeout  = 10 * time.Second
+)
+
+func newOptions(opts ...Option) options {
+	o := options{
+		interval:     defaultInterval,
+		closeTimeout: defaultCloseTimeout,
+		retries:      []time.Duration{time.Second, 3 * time.Second, 5 * time.Second},
+		logger:       io.Discard,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.httpClient == nil {
+		o.httpClient = httpclient.NewClient(httpclient.WithHTTPTimeout(defaultHTTPTimeout))
+	}
+	return o
+}
+
+// WithInterval sets how often buffered values are flushed to the server, 10 seconds by default.
+func WithInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.interval = d
+	}
+}
+
+// WithCloseTimeout limits how long Close waits for the buffered values to be sent, 5 seconds by default.
+// Zero timeout makes Close drop them.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.closeTimeout = d
+	}
+}
+
+// WithHTTPClient makes the client send requests by c instead of the default one with 10 seconds timeout.
+func WithHTTPClient(c *httpclient.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithBatchSize limits JSON batches to size bytes, zero means all values are sent in a single batch.
+func WithBatchSize(size int) Option {
+	return func(o *options) {
+		o.batchSize = size
+	}
+}
+
+// WithGzip makes the client compress batches with gzip.
+func WithGzip() Option {
+	return func(o *options) {
+		o.gzip = true
+	}
+}
+
+// WithRetries makes the client retry retriable failures after each of the delays, by default after 1, 3
+// and 5 seconds. No delays disable retries.
+func WithRetries(delays ...time.Duration) Option {
+	return func(o *options) {
+		o.retries = delays
+	}
+}
+
+// WithKey makes the client sign request bodies with HMAC-SHA256 of the key like the agent does.
+func WithKey(key string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithLabels adds the labels to every series, e.g. the service name. Labels of the series take precedence.
+func WithLabels(labels map[string]string) Option {
+	return func(o *options) {
+		o.labels = maps.Clone(labels)
+	}
+}
+
+// WithSourceID identifies the client to the server, so counters of instances behind the same address
+// are tracked separately.
+func WithSourceID(id string) Option {
+	return func(o *options) {
+		o.sourceID = id
+	}
+}
+
+// WithLogger makes the client write the log of retries and failed requests to w, it is discarded by default.
+func WithLogger(w io.Writer) Option {
+	return func(o *options) {
+		o.logger = w
+	}
+}
@@ -0,0 +1,143 @@
+package aggregation
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+)
+
+// Mode defines how a new gauge value is combined with the stored one.
+type Mode string
+
+const (
+	// Last keeps the last reported value.
+	Last Mode = "last"
+	// Min keeps the running minimum.
+	Min Mode = "min"
+	// Max keeps the running maximum.
+	Max Mode = "max"
+	// Sum keeps the sum of all reported values.
+	Sum Mode = "sum"
+	// Average keeps the average of values reported within the window.
+	Average Mode = "avg"
+)
+
+// ParseMode returns Mode by its name.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(strings.TrimSpace(s))); m {
+	case Last, Min, Max, Sum, Average:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown aggregation mode %q, expected one of %s, %s, %s, %s, %s",
+			s, Last, Min, Max, Sum, Average)
+	}
+}
+
+// ParseModes parses comma separated list of name=mode pairs, a single mode or "*=mode" pair sets
+// the default mode for the metrics that are not listed.
+func ParseModes(spec string) (Mode, map[string]Mode, error) {
+	defaultMode := Last
+	modes := make(map[string]Mode)
+	for _, item := range strings.Split(spec, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, modeName, found := strings.Cut(item, "=")
+		if !found {
+			name, modeName = "*", name
+		}
+		mode, err := ParseMode(modeName)
+		if err != nil {
+			return "", nil, err
+		}
+		if name = strings.TrimSpace(name); name == "*" {
+			defaultMode = mode
+			continue
+		}
+		modes[name] = mode
+	}
+	return defaultMode, modes, nil
+}
+
+// Aggregator combines gauge values according to the mode configured for the metric.
+type Aggregator struct {
+	mx          sync.Mutex
+	defaultMode Mode
+	modes       map[string]Mode
+	window      time.Duration
+	samples     map[string][]sample
+	now         func() time.Time
+}
+
+type sample struct {
+	ts    time.Time
+	value types.Gauge
+}
+
+// New creates new Aggregator, modes override the default mode for the listed metrics
+// and window is used by Average mode.
+func New(defaultMode Mode, modes map[string]Mode, window time.Duration) *Aggregator {
+	return &Aggregator{
+		defaultMode: defaultMode,
+		modes:       modes,
+		window:      window,
+		samples:     make(map[string][]sample),
+		now:         time.Now,
+	}
+}
+
+// Mode returns aggregation mode of the metric. Modes are configured by the metric name,
+// so all series of the metric share the mode.
+func (a *Aggregator) Mode(key string) Mode {
+	if mode, ok := a.modes[types.SeriesName(key)]; ok {
+		return mode
+	}
+	return a.defaultMode
+}
+
+// Aggregate returns the value to store for the metric given the previous stored value
+// (ok is false if there is no one) and the new reported value.
+func (a *Aggregator) Aggregate(key string, prev types.Gauge, ok bool, value types.Gauge) types.Gauge {
+	mode := a.Mode(key)
+	if !ok && mode != Average {
+		return value
+	}
+
+	switch mode {
+	case Min:
+		return min(prev, value)
+	case Max:
+		return max(prev, value)
+	case Sum:
+		return prev + value
+	case Average:
+		return a.average(key, value)
+	default:
+		return value
+	}
+}
+
+// average adds value to the window of the metric and returns average of the window.
+func (a *Aggregator) average(key string, value types.Gauge) types.Gauge {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	now := a.now()
+	from := now.Add(-a.window)
+	samples := a.samples[key]
+	i := 0
+	for i < len(samples) && samples[i].ts.Before(from) {
+		i++
+	}
+	samples = append(samples[i:], sample{ts: now, value: value})
+	a.samples[key] = samples
+
+	var sum types.Gauge
+	for _, s := range samples {
+		sum += s.value
+	}
+	return sum / types.Gauge(len(samples))
+}
@@ -0,0 +1,115 @@
+package aggregation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+)
+
+func TestParseModes(t *testing.T) {
+	tt := []struct {
+		spec       string
+		expDefault Mode
+		expModes   map[string]Mode
+		err        bool
+	}{
+		{
+			spec:       "",
+			expDefault: Last,
+			expModes:   map[string]Mode{},
+		},
+		{
+			spec:       "max",
+			expDefault: Max,
+			expModes:   map[string]Mode{},
+		},
+		{
+			spec:       "alloc=min, load = avg,*=sum",
+			expDefault: Sum,
+			expModes:   map[string]Mode{"alloc": Min, "load": Average},
+		},
+		{
+			spec: "alloc=median",
+			err:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.spec, func(t *testing.T) {
+			defaultMode, modes, err := ParseModes(tc.spec)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expDefault, defaultMode)
+			require.Equal(t, tc.expModes, modes)
+		})
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	now := time.Now()
+	a := New(Last, map[string]Mode{
+		"min": Min,
+		"max": Max,
+		"sum": Sum,
+		"avg": Average,
+	}, time.Minute)
+	a.now = func() time.Time { return now }
+
+	tt := []struct {
+		key      string
+		values   []types.Gauge
+		expected types.Gauge
+	}{
+		{
+			key:      "last",
+			values:   []types.Gauge{3, 1, 2},
+			expected: 2,
+		},
+		{
+			key:      "min",
+			values:   []types.Gauge{3, 1, 2},
+			expected: 1,
+		},
+		{
+			key:      "max",
+			values:   []types.Gauge{3, 1, 2},
+			expected: 3,
+		},
+		{
+			key:      "sum",
+			values:   []types.Gauge{3, 1, 2},
+			expected: 6,
+		},
+		{
+			key:      "avg",
+			values:   []types.Gauge{3, 1, 2},
+			expected: 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.key, func(t *testing.T) {
+			var (
+				stored types.Gauge
+				ok     bool
+			)
+			for _, v := range tc.values {
+				stored, ok = a.Aggregate(tc.key, stored, ok, v), true
+			}
+			require.Equal(t, tc.expected, stored)
+			require.Equal(t, tc.key == "last", a.Mode(tc.key) == Last)
+		})
+	}
+
+	t.Run("avg_window", func(t *testing.T) {
+		// Previous values are out of the window.
+		now = now.Add(2 * time.Minute)
+		require.Equal(t, types.Gauge(10), a.Aggregate("avg", 2, true, 10))
+	})
+}
@@ -1,24 +1,57 @@
 package handlers
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/aggregation"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
+	"github.com/ASRafalsky/telemetry/pkg/services/signature"
 )
 
-func GaugePostHandler(repo repository) func(http.ResponseWriter, *http.Request) {
+// Storage is the server side state of metrics shared by handlers.
+type Storage struct {
+	Gauges   repository
+	Counters repository
+	Metadata repository
+	// Timestamps keeps time of the last stored sample of every metric.
+	Timestamps repository
+	Rates      rateTracker
+	// Aggregation combines new gauge values with the stored ones.
+	Aggregation gaugeAggregator
+	// OutOfOrder defines what to do with gauge samples older than the stored ones.
+	OutOfOrder OutOfOrderPolicy
+	// Names is applied to metric names on every ingest and read path.
+	Names naming.Policy
+}
+
+func GaugePostHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		key := getName(req)
-		if len(key) == 0 {
-			res.WriteHeader(http.StatusNotFound)
+		key, ok := getSeriesKey(res, req, st.Names)
+		if !ok {
 			return
 		}
 
-		if err := gaugePostDataHandler(repo, key, chi.URLParam(req, "value")); err != nil {
+		err := gaugePostDataHandler(st, key, chi.URLParam(req, "value"), chi.URLParam(req, "timestamp"))
+		if errors.Is(err, errOutOfOrder) {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
 			res.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -27,20 +60,25 @@ func GaugePostHandler(repo repository) func(http.ResponseWriter, *http.Request)
 	}
 }
 
-func GaugeGetHandler(repo repository) func(http.ResponseWriter, *http.Request) {
+func GaugeGetHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		key := getName(req)
-		if len(key) == 0 {
-			res.WriteHeader(http.StatusNotFound)
+		key, ok := getSeriesKey(res, req, st.Names)
+		if !ok {
+			return
+		}
+		if key, ok = lookupSeries(res, req, st.Gauges, key); !ok {
 			return
 		}
 
-		value, err := gaugeGetDataHandler(repo, key)
+		value, err := gaugeGetDataHandler(st, key)
 		if err != nil {
 			res.WriteHeader(http.StatusNotFound)
 			return
 		}
 
+		setMetadataHeaders(res, st, gaugeType, key)
+		setTimestampHeader(res, st, gaugeType, key)
+		res.Header().Set("X-Gauge-Aggregation", string(st.Aggregation.Mode(key)))
 		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		_, err = io.WriteString(res, value)
 		if err != nil {
@@ -50,15 +88,15 @@ func GaugeGetHandler(repo repository) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func CounterPostHandler(repo repository) func(http.ResponseWriter, *http.Request) {
+func CounterPostHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		key := getName(req)
-		if len(key) == 0 {
-			res.WriteHeader(http.StatusNotFound)
+		key, ok := getSeriesKey(res, req, st.Names)
+		if !ok {
 			return
 		}
 
-		if err := counterPostDataHandler(repo, strings.ToLower(key), chi.URLParam(req, "value")); err != nil {
+		err := counterPostDataHandler(st, getSource(req), key, chi.URLParam(req, "value"), chi.URLParam(req, "timestamp"))
+		if err != nil {
 			res.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -67,20 +105,174 @@ func CounterPostHandler(repo repository) func(http.ResponseWriter, *http.Request
 	}
 }
 
-func CounterGetHandler(repo repository) func(http.ResponseWriter, *http.Request) {
+func CounterGetHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		key := getName(req)
-		if len(key) == 0 {
+		key, ok := getSeriesKey(res, req, st.Names)
+		if !ok {
+			return
+		}
+		if key, ok = lookupSeries(res, req, st.Counters, key); !ok {
+			return
+		}
+
+		value, err := counterGetDataHandler(st, key)
+		if err != nil {
 			res.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		value, err := counterGetDataHandler(repo, key)
+		setMetadataHeaders(res, st, counterType, key)
+		setTimestampHeader(res, st, counterType, key)
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(res, value)
 		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func UpdateHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		// Plain text updates must have name and value in the URL.
+		if !isJSON(req) {
 			res.WriteHeader(http.StatusNotFound)
 			return
 		}
 
+		var m types.Metrics
+		if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m, err := updateDataHandler(st, getSource(req), m)
+		switch {
+		case errors.Is(err, errOutOfOrder):
+			res.Header().Set("Content-Type", "application/json")
+			res.WriteHeader(http.StatusConflict)
+		case err != nil:
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			res.Header().Set("Content-Type", "application/json")
+		}
+
+		if err = json.NewEncoder(res).Encode(m); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func UpdatesHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !isJSON(req) {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var batch []types.Metrics
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		batch, err := updatesDataHandler(st, getSource(req), batch)
+		switch {
+		case errors.Is(err, errOutOfOrder):
+			// Nothing is applied, so the batch may be sent again without the rejected samples.
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			res.Header().Set("Content-Type", "application/json")
+		}
+
+		if err = json.NewEncoder(res).Encode(batch); err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Decompress is a middleware which decompresses gzip encoded request bodies.
+func Decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !strings.Contains(req.Header.Get("Content-Encoding"), "gzip") {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+
+		req.Body = gz
+		req.Header.Del("Content-Encoding")
+		req.Header.Del("Content-Length")
+		req.ContentLength = -1
+		next.ServeHTTP(res, req)
+	})
+}
+
+// MaxSignedBodySize is the max size of request bodies read by VerifySignature.
+const MaxSignedBodySize = 32 << 20
+
+// VerifySignature is a middleware which rejects POST requests without valid HMAC-SHA256 signature of the body
+// in the HashSHA256 header and requests with bodies larger than MaxSignedBodySize. All requests are passed
+// if the key is empty.
+func VerifySignature(key string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if key == "" || req.Method != http.MethodPost {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, MaxSignedBodySize))
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				http.Error(res, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !signature.Verify(key, body, req.Header.Get(signature.Header)) {
+				http.Error(res, "invalid signature", http.StatusBadRequest)
+				return
+			}
+
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+func CounterRateHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, ok := getSeriesKey(res, req, st.Names)
+		if !ok {
+			return
+		}
+		if key, ok = lookupSeries(res, req, st.Counters, key); !ok {
+			return
+		}
+
+		value, resets, err := counterRateDataHandler(st, key)
+		if err != nil {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		res.Header().Set("X-Counter-Resets", strconv.Itoa(resets))
 		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		_, err = io.WriteString(res, value)
 		if err != nil {
@@ -90,6 +282,56 @@ func CounterGetHandler(repo repository) func(http.ResponseWriter, *http.Request)
 	}
 }
 
+func MetadataPostHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, ok := getNormalizedName(res, req, st.Names)
+		if !ok {
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if err = metadataPostDataHandler(st, chi.URLParam(req, "type"), key, body); err != nil {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+}
+
+func MetadataGetHandler(st *Storage) func(http.ResponseWriter, *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key, ok := getNormalizedName(res, req, st.Names)
+		if !ok {
+			return
+		}
+
+		mType := chi.URLParam(req, "type")
+		if !isKnownType(mType) {
+			res.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		value, err := metadataGetDataHandler(st, mType, key)
+		if err != nil {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		res.Header().Set("Content-Type", "application/json")
+		_, err = res.Write(value)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 func FailurePostHandler() func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		key := getName(req)
@@ -107,15 +349,10 @@ func FailureGetHandler() func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func AllGetHandler(tmpl *template.Template, repos ...repository) func(http.ResponseWriter, *http.Request) {
+func AllGetHandler(tmpl *template.Template, st *Storage) func(http.ResponseWriter, *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
-		if len(repos) == 0 {
-			res.WriteHeader(http.StatusNotFound)
-			return
-		}
-
 		res.Header().Set("Content-Type", "text/html; charset=utf-8")
-		err := tmpl.Execute(res, getKeyList(repos...))
+		err := tmpl.Execute(res, getEntryList(st))
 		if err != nil {
 			http.Error(res, err.Error(), http.StatusInternalServerError)
 			return
@@ -127,10 +364,130 @@ func getName(req *http.Request) string {
 	return chi.URLParam(req, "name")
 }
 
+// getNormalizedName returns the metric name normalized by the policy. If the name is empty or invalid
+// it writes error status to the response and returns false.
+func getNormalizedName(res http.ResponseWriter, req *http.Request, names naming.Policy) (string, bool) {
+	key := getName(req)
+	if len(key) == 0 {
+		res.WriteHeader(http.StatusNotFound)
+		return "", false
+	}
+	key, err := names.Normalize(key)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// getSeriesKey returns key of the metric series: the normalized name with labels from the query parameters.
+// If the name or labels are invalid it writes error status to the response and returns false.
+func getSeriesKey(res http.ResponseWriter, req *http.Request, names naming.Policy) (string, bool) {
+	name, ok := getNormalizedName(res, req, names)
+	if !ok {
+		return "", false
+	}
+	query := req.URL.Query()
+	labels := make(types.Labels, len(query))
+	for label, values := range query {
+		if len(values) != 1 {
+			http.Error(res, fmt.Sprintf("label %q is set %d times", label, len(values)), http.StatusBadRequest)
+			return "", false
+		}
+		labels[label] = values[0]
+	}
+	if err := naming.ValidateLabels(labels); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return types.SeriesKey(name, labels), true
+}
+
+// lookupSeries returns key of the stored series matching the requested one, see findSeries. If no series
+// or several ones match, it writes error status to the response and returns false, the conflict response
+// lists the matching series, so the request can be repeated with their labels.
+func lookupSeries(res http.ResponseWriter, req *http.Request, repo repository, key string) (string, bool) {
+	keys := findSeries(req.Context(), repo, key)
+	switch len(keys) {
+	case 0:
+		res.WriteHeader(http.StatusNotFound)
+	case 1:
+		return keys[0], true
+	default:
+		http.Error(res, "several series match, select one by labels:\n"+strings.Join(keys, "\n"), http.StatusConflict)
+	}
+	return "", false
+}
+
+func isJSON(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/json")
+}
+
+// source is the sender of the request.
+type source struct {
+	// id is X-Source-ID header if it is set or remote host.
+	id string
+	// deltas is true if counter values are increments since the previous report rather than cumulative values.
+	deltas bool
+}
+
+// getSource returns the metric source of the request.
+func getSource(req *http.Request) source {
+	src := source{id: req.Header.Get(types.SourceIDHeader), deltas: req.Header.Get(types.CounterModeHeader) == types.CounterModeDelta}
+	if src.id != "" {
+		return src
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	src.id = host
+	return src
+}
+
+// setTimestampHeader adds time of the stored sample to the response headers.
+func setTimestampHeader(res http.ResponseWriter, st *Storage, mType, key string) {
+	if value, ok := st.Timestamps.Get(typedKey(mType, key)); ok {
+		res.Header().Set("X-Metric-Timestamp", types.BytesToTime(value).Format(time.RFC3339Nano))
+	}
+}
+
+// setMetadataHeaders adds registered metadata of the metric to the response headers.
+// Metadata is registered by the metric name, so it is shared by all series of the metric.
+func setMetadataHeaders(res http.ResponseWriter, st *Storage, mType, key string) {
+	value, err := metadataGetDataHandler(st, mType, types.SeriesName(key))
+	if err != nil {
+		return
+	}
+	md := types.BytesToMetadata(value)
+	for header, v := range map[string]string{
+		"X-Metric-Description": md.Description,
+		"X-Metric-Unit":        md.Unit,
+		"X-Metric-Owner":       md.Owner,
+	} {
+		if v != "" {
+			res.Header().Set(header, v)
+		}
+	}
+}
+
 type repository interface {
 	Set(k string, v []byte)
 	Get(k string) ([]byte, bool)
+	Update(k string, fn func(v []byte, ok bool) []byte) []byte
 	ForEach(ctx context.Context, fn func(k string, v []byte) error) error
 	Size() int
 	Delete(k string)
 }
+
+type rateTracker interface {
+	Observe(key, src string, value types.Counter) (int, bool)
+	ObserveDelta(key, src string, delta types.Counter) int
+	Rate(key string) (types.Gauge, bool)
+	Resets(key string) int
+}
+
+type gaugeAggregator interface {
+	Mode(key string) aggregation.Mode
+	Aggregate(key string, prev types.Gauge, ok bool, value types.Gauge) types.Gauge
+}
@@ -3,58 +3,363 @@ package handlers
 import (
 	"context"
 	"errors"
-	"strings"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
 )
 
-func counterPostDataHandler(repo repository, key string, value string) error {
+const (
+	gaugeType   = "gauge"
+	counterType = "counter"
+)
+
+// OutOfOrderPolicy defines what to do with a gauge sample older than the stored one.
+type OutOfOrderPolicy string
+
+const (
+	// DropOutOfOrder ignores the sample and reports success.
+	DropOutOfOrder OutOfOrderPolicy = "drop"
+	// RejectOutOfOrder ignores the sample and reports an error.
+	RejectOutOfOrder OutOfOrderPolicy = "reject"
+)
+
+var errOutOfOrder = errors.New("sample is older than the stored one")
+
+// ParseOutOfOrderPolicy returns OutOfOrderPolicy by its name.
+func ParseOutOfOrderPolicy(s string) (OutOfOrderPolicy, error) {
+	switch p := OutOfOrderPolicy(s); p {
+	case DropOutOfOrder, RejectOutOfOrder:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown out of order policy %q, expected %s or %s", s, DropOutOfOrder, RejectOutOfOrder)
+	}
+}
+
+// entry is a metric shown on the index page.
+type entry struct {
+	Name string
+	// Labels distinguish series of the same metric.
+	Labels string
+	Type   string
+	// Aggregation is set for gauges only.
+	Aggregation string
+	Updated     string
+	types.Metadata
+}
+
+func isKnownType(mType string) bool {
+	return mType == gaugeType || mType == counterType
+}
+
+// typedKey returns key of the metric in repositories shared by all metric types.
+func typedKey(mType, key string) string {
+	return mType + "/" + key
+}
+
+// getTimestamp returns sample time from string or receive time if the string is empty.
+func getTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now(), nil
+	}
+	return types.ParseTimestamp(value)
+}
+
+func counterPostDataHandler(st *Storage, src source, key, value, timestamp string) error {
 	newValue, err := types.ParseCounter(value)
 	if err != nil {
 		return err
 	}
-	if previousValue, ok := repo.Get(strings.ToLower(key)); ok {
-		newValue += types.BytesToCounter(previousValue)
+	ts, err := getTimestamp(timestamp)
+	if err != nil {
+		return err
 	}
-	repo.Set(strings.ToLower(key), types.CounterToBytes(newValue))
+	updateCounter(st, src, key, newValue, ts)
 	return nil
 }
 
-func gaugeGetDataHandler(repo repository, key string) (string, error) {
-	if value, ok := repo.Get(strings.ToLower(key)); ok {
+// updateCounter adds value to the stored counter. The out of order policy doesn't apply to counters: a sample
+// is an increment which has to be counted however late it is, so only the latest timestamp is kept.
+func updateCounter(st *Storage, src source, key string, value types.Counter, ts time.Time) types.Counter {
+	if src.deltas {
+		st.Rates.ObserveDelta(key, src.id, value)
+	} else if epoch, reset := st.Rates.Observe(key, src.id, value); reset {
+		fmt.Printf("[counter] %s is reset by %s, epoch %d\n", key, src.id, epoch)
+	}
+	newValue := st.Counters.Update(key, func(previousValue []byte, ok bool) []byte {
+		st.Timestamps.Update(typedKey(counterType, key), func(previousTS []byte, ok bool) []byte {
+			if ok && types.BytesToTime(previousTS).After(ts) {
+				return previousTS
+			}
+			return types.TimeToBytes(ts)
+		})
+		if ok {
+			value += types.BytesToCounter(previousValue)
+		}
+		return types.CounterToBytes(value)
+	})
+	return types.BytesToCounter(newValue)
+}
+
+// findSeries returns keys of the stored series matching the requested one: the key itself if it is stored,
+// otherwise the series of the metric having all labels of the key, e.g. the only series of an agent
+// is found without its identity labels.
+func findSeries(ctx context.Context, repo repository, key string) []string {
+	if _, ok := repo.Get(key); ok {
+		return []string{key}
+	}
+	name, labels, err := types.ParseSeriesKey(key)
+	if err != nil {
+		return nil
+	}
+
+	var keys []string
+	_ = repo.ForEach(ctx, func(k string, _ []byte) error {
+		if types.SeriesName(k) != name {
+			return nil
+		}
+		_, series, err := types.ParseSeriesKey(k)
+		if err != nil {
+			return nil
+		}
+		for label, value := range labels {
+			if v, ok := series[label]; !ok || v != value {
+				return nil
+			}
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func gaugeGetDataHandler(st *Storage, key string) (string, error) {
+	if value, ok := st.Gauges.Get(key); ok {
 		return types.BytesToGauge(value).String(), nil
 	}
 	return "", errors.New("gauge value not found")
 }
 
-func counterGetDataHandler(repo repository, key string) (string, error) {
-	if value, ok := repo.Get(strings.ToLower(key)); ok {
+func counterGetDataHandler(st *Storage, key string) (string, error) {
+	if value, ok := st.Counters.Get(key); ok {
 		return types.BytesToCounter(value).String(), nil
 	}
 	return "", errors.New("counter value not found")
 }
 
-func gaugePostDataHandler(repo repository, key string, value string) error {
+func counterRateDataHandler(st *Storage, key string) (string, int, error) {
+	if rate, ok := st.Rates.Rate(key); ok {
+		return rate.String(), st.Rates.Resets(key), nil
+	}
+	return "", 0, errors.New("counter rate not found")
+}
+
+func gaugePostDataHandler(st *Storage, key, value, timestamp string) error {
 	newValue, err := types.ParseGauge(value)
 	if err != nil {
 		return err
 	}
-	repo.Set(strings.ToLower(key), types.GaugeToBytes(newValue))
+	ts, err := getTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+	_, err = updateGauge(st, key, newValue, ts)
+	return err
+}
+
+// updateGauge aggregates value with the stored gauge unless the sample is older than the stored one.
+func updateGauge(st *Storage, key string, value types.Gauge, ts time.Time) (types.Gauge, error) {
+	var outOfOrder bool
+	newValue := st.Gauges.Update(key, func(previousValue []byte, ok bool) []byte {
+		st.Timestamps.Update(typedKey(gaugeType, key), func(previousTS []byte, tsOK bool) []byte {
+			if ok && tsOK && types.BytesToTime(previousTS).After(ts) {
+				outOfOrder = true
+				return previousTS
+			}
+			return types.TimeToBytes(ts)
+		})
+		if outOfOrder {
+			return previousValue
+		}
+		var prev types.Gauge
+		if ok {
+			prev = types.BytesToGauge(previousValue)
+		}
+		return types.GaugeToBytes(st.Aggregation.Aggregate(key, prev, ok, value))
+	})
+	if outOfOrder && st.OutOfOrder == RejectOutOfOrder {
+		return types.BytesToGauge(newValue), errOutOfOrder
+	}
+	return types.BytesToGauge(newValue), nil
+}
+
+// updateDataHandler applies JSON encoded metric update and returns the stored metric.
+func updateDataHandler(st *Storage, src source, m types.Metrics) (types.Metrics, error) {
+	if err := validateMetrics(st, m); err != nil {
+		return m, err
+	}
+	name, err := st.Names.Normalize(m.ID)
+	if err != nil {
+		return m, err
+	}
+	key := types.SeriesKey(name, m.Labels)
+	ts := time.Now()
+	if m.Timestamp != 0 {
+		ts = time.UnixMilli(m.Timestamp)
+	}
+
+	res := types.Metrics{ID: name, MType: m.MType, Labels: m.Labels}
+	switch m.MType {
+	case gaugeType:
+		var value types.Gauge
+		value, err = updateGauge(st, key, types.Gauge(*m.Value), ts)
+		res.Value = (*float64)(&value)
+	case counterType:
+		value := updateCounter(st, src, key, types.Counter(*m.Delta), ts)
+		res.Delta = (*int64)(&value)
+	default:
+	}
+	if value, ok := st.Timestamps.Get(typedKey(m.MType, key)); ok {
+		res.Timestamp = types.BytesToTime(value).UnixMilli()
+	}
+	return res, err
+}
+
+// updatesDataHandler validates the batch of JSON encoded metric updates and applies them if all of them are valid
+// and, with RejectOutOfOrder policy, none of the gauge samples is out of order. It returns stored metrics in
+// the order of the batch.
+func updatesDataHandler(st *Storage, src source, batch []types.Metrics) ([]types.Metrics, error) {
+	for _, m := range batch {
+		if err := validateMetrics(st, m); err != nil {
+			return nil, fmt.Errorf("%s: %w", m.ID, err)
+		}
+	}
+	if st.OutOfOrder == RejectOutOfOrder {
+		if err := checkOrder(st, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	var errRes error
+	result := make([]types.Metrics, 0, len(batch))
+	for _, m := range batch {
+		res, err := updateDataHandler(st, src, m)
+		// A sample which is out of order because of a concurrent update after the check is dropped,
+		// so the batch is never applied partially.
+		if err != nil && !errors.Is(err, errOutOfOrder) {
+			errRes = err
+		}
+		result = append(result, res)
+	}
+	return result, errRes
+}
+
+// checkOrder returns errOutOfOrder if a gauge sample of the batch is older than the stored one or than
+// a previous sample of the same series in the batch.
+func checkOrder(st *Storage, batch []types.Metrics) error {
+	now := time.Now()
+	latest := make(map[string]time.Time)
+	for _, m := range batch {
+		if m.MType != gaugeType {
+			continue
+		}
+		name, err := st.Names.Normalize(m.ID)
+		if err != nil {
+			return err
+		}
+		key := types.SeriesKey(name, m.Labels)
+		ts := now
+		if m.Timestamp != 0 {
+			ts = time.UnixMilli(m.Timestamp)
+		}
+
+		prev, ok := latest[key]
+		if !ok {
+			if _, stored := st.Gauges.Get(key); stored {
+				var value []byte
+				value, ok = st.Timestamps.Get(typedKey(gaugeType, key))
+				prev = types.BytesToTime(value)
+			}
+		}
+		if ok && prev.After(ts) {
+			return fmt.Errorf("%s: %w", m.ID, errOutOfOrder)
+		}
+		latest[key] = ts
+	}
 	return nil
 }
 
-func getKeyList(repos ...repository) []string {
-	totalEntryCnt := 0
-	for _, repo := range repos {
-		totalEntryCnt += repo.Size()
+func validateMetrics(st *Storage, m types.Metrics) error {
+	if _, err := st.Names.Normalize(m.ID); err != nil {
+		return err
 	}
+	if err := naming.ValidateLabels(m.Labels); err != nil {
+		return err
+	}
+	switch {
+	case m.MType == gaugeType && m.Value == nil:
+		return errors.New("gauge value is missing")
+	case m.MType == counterType && m.Delta == nil:
+		return errors.New("counter delta is missing")
+	case !isKnownType(m.MType):
+		return errors.New("unknown metric type")
+	default:
+		return nil
+	}
+}
+
+func metadataPostDataHandler(st *Storage, mType, key string, value []byte) error {
+	if !isKnownType(mType) {
+		return errors.New("unknown metric type")
+	}
+	md, err := types.ParseMetadata(value)
+	if err != nil {
+		return err
+	}
+	st.Metadata.Set(typedKey(mType, key), types.MetadataToBytes(md))
+	return nil
+}
+
+func metadataGetDataHandler(st *Storage, mType, key string) ([]byte, error) {
+	if value, ok := st.Metadata.Get(typedKey(mType, key)); ok {
+		return value, nil
+	}
+	return nil, errors.New("metadata not found")
+}
 
-	result := make([]string, totalEntryCnt)
-	for _, repo := range repos {
+func getEntryList(st *Storage) []entry {
+	result := make([]entry, 0, st.Gauges.Size()+st.Counters.Size())
+	for mType, repo := range map[string]repository{gaugeType: st.Gauges, counterType: st.Counters} {
 		_ = repo.ForEach(context.Background(), func(k string, _ []byte) error {
-			result = append(result, k)
+			name, labels, err := types.ParseSeriesKey(k)
+			if err != nil {
+				return nil
+			}
+			e := entry{Name: name, Labels: labels.String(), Type: mType}
+			if mType == gaugeType {
+				e.Aggregation = string(st.Aggregation.Mode(k))
+			}
+			if ts, ok := st.Timestamps.Get(typedKey(mType, k)); ok {
+				e.Updated = types.BytesToTime(ts).Format(time.RFC3339)
+			}
+			if md, ok := st.Metadata.Get(typedKey(mType, name)); ok {
+				e.Metadata = types.BytesToMetadata(md)
+			}
+			result = append(result, e)
 			return nil
 		})
 	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		if result[i].Labels != result[j].Labels {
+			return result[i].Labels < result[j].Labels
+		}
+		return result[i].Type < result[j].Type
+	})
 	return result
 }
@@ -0,0 +1,102 @@
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Policy defines how metric names are normalized on ingest and read.
+type Policy string
+
+const (
+	// Preserve keeps names as is, so names are case-sensitive.
+	Preserve Policy = "preserve"
+	// Lowercase converts names to lower case, so names are case-insensitive.
+	Lowercase Policy = "lowercase"
+	// Prometheus replaces characters not allowed by Prometheus data model with underscores.
+	Prometheus Policy = "prometheus"
+)
+
+// MaxLength is the maximum length of the normalized metric name.
+const MaxLength = 255
+
+var (
+	ErrInvalidName  = errors.New("invalid metric name")
+	ErrInvalidLabel = errors.New("invalid label name")
+)
+
+// ParsePolicy returns Policy by its name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case Preserve, Lowercase, Prometheus:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown naming policy %q, expected one of %s, %s, %s", s, Preserve, Lowercase, Prometheus)
+	}
+}
+
+// Normalize returns name normalized by the policy or ErrInvalidName if the name is empty, too long
+// or contains characters outside the allowed charset.
+func (p Policy) Normalize(name string) (string, error) {
+	switch p {
+	case Lowercase:
+		name = strings.ToLower(name)
+	case Prometheus:
+		name = sanitize(name)
+	default:
+	}
+
+	if len(name) == 0 || len(name) > MaxLength {
+		return "", fmt.Errorf("%w: length must be from 1 to %d characters", ErrInvalidName, MaxLength)
+	}
+	for _, r := range name {
+		if !isAllowed(r) {
+			return "", fmt.Errorf("%w: %q contains %q, allowed characters are letters, digits and _.:-",
+				ErrInvalidName, name, r)
+		}
+	}
+	return name, nil
+}
+
+// ValidateLabels returns ErrInvalidLabel if any label name doesn't match [a-zA-Z_][a-zA-Z0-9_]*.
+// Label names are never normalized, since they are part of the series identity.
+func ValidateLabels(labels map[string]string) error {
+	for name := range labels {
+		if name == "" {
+			return fmt.Errorf("%w: name is empty", ErrInvalidLabel)
+		}
+		for i, r := range name {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+				return fmt.Errorf("%w: %q contains %q, allowed characters are letters, digits and _",
+					ErrInvalidLabel, name, r)
+			}
+		}
+	}
+	return nil
+}
+
+// sanitize converts name to match Prometheus regexp [a-zA-Z_:][a-zA-Z0-9_:]*.
+func sanitize(name string) string {
+	var sb strings.Builder
+	sb.Grow(len(name) + 1)
+	for i, r := range name {
+		switch {
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+			sb.WriteRune(r)
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+func isAllowed(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '_' || r == '.' || r == ':' || r == '-'
+}
@@ -0,0 +1,103 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"preserve", "lowercase", "Prometheus"} {
+		p, err := ParsePolicy(name)
+		require.NoError(t, err)
+		require.Equal(t, Policy(strings.ToLower(name)), p)
+	}
+	_, err := ParsePolicy("lol")
+	require.Error(t, err)
+}
+
+func TestNormalize(t *testing.T) {
+	tt := []struct {
+		name     string
+		policy   Policy
+		in       string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "preserve",
+			policy:   Preserve,
+			in:       "PollCount",
+			expected: "PollCount",
+		},
+		{
+			name:     "lowercase",
+			policy:   Lowercase,
+			in:       "PollCount",
+			expected: "pollcount",
+		},
+		{
+			name:     "prometheus",
+			policy:   Prometheus,
+			in:       "go.gc-pause:total",
+			expected: "go_gc_pause:total",
+		},
+		{
+			name:     "prometheus_leading_digit",
+			policy:   Prometheus,
+			in:       "1st metric",
+			expected: "_1st_metric",
+		},
+		{
+			name:     "dotted_name",
+			policy:   Preserve,
+			in:       "agent.send.duration",
+			expected: "agent.send.duration",
+		},
+		{
+			name:   "wrong_charset",
+			policy: Preserve,
+			in:     "Poll Count",
+			err:    true,
+		},
+		{
+			name:   "wrong_charset_lowercase",
+			policy: Lowercase,
+			in:     "счётчик",
+			err:    true,
+		},
+		{
+			name:   "empty",
+			policy: Prometheus,
+			in:     "",
+			err:    true,
+		},
+		{
+			name:   "too_long",
+			policy: Lowercase,
+			in:     strings.Repeat("a", MaxLength+1),
+			err:    true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			name, err := tc.policy.Normalize(tc.in)
+			if tc.err {
+				require.ErrorIs(t, err, ErrInvalidName)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, name)
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	require.NoError(t, ValidateLabels(nil))
+	require.NoError(t, ValidateLabels(map[string]string{"process": "nginx", "_pid2": "", "Host": "a b"}))
+	for _, name := range []string{"", "2pid", "process-name", "proc.name"} {
+		require.ErrorIs(t, ValidateLabels(map[string]string{name: "v"}), ErrInvalidLabel, name)
+	}
+}
@@ -0,0 +1,217 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileExt = ".json"
+
+// Entry is a request persisted until the server acknowledges it.
+type Entry struct {
+	// ID is assigned by Put.
+	ID      string      `json:"-"`
+	Path    string      `json:"path"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Created time.Time   `json:"created"`
+}
+
+// Outbox is an on-disk queue of requests, a file per entry. When the caps are exceeded the oldest
+// entries are dropped. The directory is scanned on open only, so it must not be shared by processes.
+type Outbox struct {
+	mx  sync.Mutex
+	dir string
+	// maxSize is the max total size of entries in bytes, zero means no limit.
+	maxSize int64
+	// maxAge is the max age of entries, zero means no limit.
+	maxAge time.Duration
+	seq    uint64
+	now    func() time.Time
+	// files are the entries from the oldest to the newest, size is their total size.
+	files []file
+	size  int64
+}
+
+// New opens the outbox in dir creating it if needed, entries left by the previous run are kept.
+func New(dir string, maxSize int64, maxAge time.Duration) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	files, err := scan(dir)
+	if err != nil {
+		return nil, err
+	}
+	o := &Outbox{dir: dir, maxSize: maxSize, maxAge: maxAge, now: time.Now, files: files}
+	for _, f := range files {
+		o.size += f.size
+	}
+	return o, nil
+}
+
+// Put persists the entry and returns its ID.
+func (o *Outbox) Put(e Entry) (string, error) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if e.Created.IsZero() {
+		e.Created = o.now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	// Names are ordered by creation time, the sequence number keeps them unique.
+	o.seq++
+	id := fmt.Sprintf("%020d-%06d", e.Created.UnixNano(), o.seq%1_000_000)
+	tmp := filepath.Join(o.dir, id+".tmp")
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return "", err
+	}
+	if err = os.Rename(tmp, filepath.Join(o.dir, id+fileExt)); err != nil {
+		return "", errors.Join(err, os.Remove(tmp))
+	}
+
+	f := file{name: id + fileExt, created: e.Created, size: int64(len(data))}
+	// Entries are mostly put in order, older ones are inserted at their place.
+	i := sort.Search(len(o.files), func(i int) bool { return o.files[i].name > f.name })
+	o.files = slices.Insert(o.files, i, f)
+	o.size += f.size
+	return id, o.trim()
+}
+
+// Remove deletes the acknowledged entry.
+func (o *Outbox) Remove(id string) error {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	err := os.Remove(filepath.Join(o.dir, id+fileExt))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	o.forget(id + fileExt)
+	return nil
+}
+
+// List returns entries from the oldest to the newest after dropping the ones exceeding the caps.
+func (o *Outbox) List() ([]Entry, error) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if err := o.trim(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(o.files))
+	var broken []string
+	for _, f := range o.files {
+		data, err := os.ReadFile(filepath.Join(o.dir, f.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			broken = append(broken, f.name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e Entry
+		if err = json.Unmarshal(data, &e); err != nil {
+			// A broken entry can not be sent, so it is dropped.
+			fmt.Printf("[outbox] Dropped broken entry %s; %s\n", f.name, err)
+			_ = os.Remove(filepath.Join(o.dir, f.name))
+			broken = append(broken, f.name)
+			continue
+		}
+		e.ID = strings.TrimSuffix(f.name, fileExt)
+		entries = append(entries, e)
+	}
+	for _, name := range broken {
+		o.forget(name)
+	}
+	return entries, nil
+}
+
+// trim drops the oldest entries while they are older than maxAge or the total size exceeds maxSize.
+func (o *Outbox) trim() error {
+	var dropped int
+	for _, f := range o.files {
+		expired := o.maxAge > 0 && o.now().Sub(f.created) > o.maxAge
+		if !expired && (o.maxSize <= 0 || o.size <= o.maxSize) {
+			break
+		}
+		if err := os.Remove(filepath.Join(o.dir, f.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			o.drop(dropped)
+			return err
+		}
+		o.size -= f.size
+		dropped++
+	}
+	o.drop(dropped)
+	return nil
+}
+
+// drop removes the n oldest files from the index, their sizes are already subtracted.
+func (o *Outbox) drop(n int) {
+	if n == 0 {
+		return
+	}
+	o.files = slices.Delete(o.files, 0, n)
+	fmt.Printf("[outbox] Dropped %d oldest entries\n", n)
+}
+
+// forget removes the file from the index.
+func (o *Outbox) forget(name string) {
+	i, ok := slices.BinarySearchFunc(o.files, name, func(f file, name string) int {
+		return strings.Compare(f.name, name)
+	})
+	if ok {
+		o.size -= o.files[i].size
+		o.files = slices.Delete(o.files, i, i+1)
+	}
+}
+
+type file struct {
+	name    string
+	created time.Time
+	size    int64
+}
+
+// scan returns entry files in dir from the oldest to the newest.
+func scan(dir string) ([]file, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]file, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		name := de.Name()
+		if de.IsDir() || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+		nanos, _, _ := strings.Cut(name, "-")
+		ts, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{name: name, created: time.Unix(0, ts), size: info.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	return files, nil
+}
@@ -0,0 +1,88 @@
+package outbox
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox(t *testing.T) {
+	t.Run("put_list_remove", func(t *testing.T) {
+		dir := t.TempDir()
+		ob, err := New(dir, 0, 0)
+		require.NoError(t, err)
+
+		header := http.Header{"Content-Type": []string{"application/json"}}
+		first, err := ob.Put(Entry{Path: "/updates/", Header: header, Body: []byte("[1]")})
+		require.NoError(t, err)
+		second, err := ob.Put(Entry{Path: "/updates/", Header: header, Body: []byte("[2]")})
+		require.NoError(t, err)
+
+		// Entries survive restart.
+		ob, err = New(dir, 0, 0)
+		require.NoError(t, err)
+		entries, err := ob.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, first, entries[0].ID)
+		require.Equal(t, []byte("[1]"), entries[0].Body)
+		require.Equal(t, header, entries[0].Header)
+		require.Equal(t, "/updates/", entries[0].Path)
+		require.Equal(t, second, entries[1].ID)
+
+		require.NoError(t, ob.Remove(first))
+		require.NoError(t, ob.Remove(first))
+		entries, err = ob.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, second, entries[0].ID)
+
+		// The size is tracked without rescanning the directory.
+		require.NoError(t, ob.Remove(second))
+		require.Empty(t, ob.files)
+		require.Zero(t, ob.size)
+	})
+
+	t.Run("max_size", func(t *testing.T) {
+		ob, err := New(t.TempDir(), 0, 0)
+		require.NoError(t, err)
+		// Entries of the same time have the same size, since the encoded time length depends on it.
+		now := time.Now()
+		ob.now = func() time.Time { return now }
+		_, err = ob.Put(Entry{Path: "/updates/", Body: []byte("first")})
+		require.NoError(t, err)
+
+		// Only two entries fit.
+		ob.maxSize = 2*ob.files[0].size + 2
+		for _, body := range []string{"second", "third"} {
+			_, err = ob.Put(Entry{Path: "/updates/", Body: []byte(body)})
+			require.NoError(t, err)
+		}
+
+		entries, err := ob.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.Equal(t, []byte("second"), entries[0].Body)
+		require.Equal(t, []byte("third"), entries[1].Body)
+	})
+
+	t.Run("max_age", func(t *testing.T) {
+		ob, err := New(t.TempDir(), 0, time.Minute)
+		require.NoError(t, err)
+		now := time.Now()
+		ob.now = func() time.Time { return now }
+
+		_, err = ob.Put(Entry{Path: "/new"})
+		require.NoError(t, err)
+		// Older entries are inserted before the newer ones.
+		_, err = ob.Put(Entry{Path: "/old", Created: now.Add(-2 * time.Minute)})
+		require.NoError(t, err)
+
+		entries, err := ob.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		require.Equal(t, "/new", entries[0].Path)
+	})
+}
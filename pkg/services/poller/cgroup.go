@@ -0,0 +1,294 @@
+package poller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+func init() {
+	Register("cgroup", func(cfg Config) (Collector, error) {
+		root, proc := cgroupRoot, procRoot
+		if v, ok := cfg.Params["root"]; ok {
+			root = v
+		}
+		if v, ok := cfg.Params["proc"]; ok {
+			proc = v
+		}
+		return newCgroupCollector(root, proc, cfg.Interval, splitParam(cfg.Params["paths"])), nil
+	})
+}
+
+// cpuStatCounters maps keys of cpu.stat to counters.
+var cpuStatCounters = map[string]string{
+	"usage_usec":     "CgroupCPUUsageMicroseconds",
+	"user_usec":      "CgroupCPUUserMicroseconds",
+	"system_usec":    "CgroupCPUSystemMicroseconds",
+	"nr_periods":     "CgroupCPUPeriods",
+	"nr_throttled":   "CgroupCPUThrottledPeriods",
+	"throttled_usec": "CgroupCPUThrottledMicroseconds",
+}
+
+// ioStatCounters maps keys of io.stat to counters.
+var ioStatCounters = map[string]string{
+	"rbytes": "CgroupIOReadBytes",
+	"wbytes": "CgroupIOWriteBytes",
+	"rios":   "CgroupIOReads",
+	"wios":   "CgroupIOWrites",
+}
+
+// cgroupCollector collects CPU, memory, IO and pids usage, limits and throttling of cgroup v2 groups
+// mounted at root. Paths are relative to root, by default the group of the agent is read from
+// procfs mounted at proc. Series are labelled by the cgroup path.
+type cgroupCollector struct {
+	root     string
+	proc     string
+	interval time.Duration
+	paths    []string
+	// counters keep values of the previous poll, since the sink takes deltas.
+	counters Counters
+	// series removes gauges of removed limits and groups.
+	series gaugeSeries
+}
+
+func newCgroupCollector(root, proc string, interval time.Duration, paths []string) *cgroupCollector {
+	return &cgroupCollector{
+		root:     root,
+		proc:     proc,
+		interval: interval,
+		paths:    paths,
+	}
+}
+
+func (c *cgroupCollector) Name() string {
+	return "cgroup"
+}
+
+func (c *cgroupCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *cgroupCollector) Collect(_ context.Context, sink Sink) error {
+	paths := c.paths
+	if len(paths) == 0 {
+		self, err := c.self()
+		if err != nil {
+			return err
+		}
+		paths = []string{self}
+	}
+
+	var err error
+	tracked := c.series.track(sink)
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		if collectErr := c.collectGroup(tracked, p); collectErr != nil {
+			err = multierr.Append(err, fmt.Errorf("cgroup %s: %w", p, collectErr))
+		}
+	}
+	c.series.sweep(sink)
+	return err
+}
+
+// self returns the cgroup v2 path of the agent, the "0::/path" line of /proc/self/cgroup.
+func (c *cgroupCollector) self() (string, error) {
+	data, err := os.ReadFile(filepath.Join(c.proc, "self", "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if p, ok := strings.CutPrefix(line, "0::"); ok {
+			return p, nil
+		}
+	}
+	return "", errors.New("cgroup v2 is not used by the agent")
+}
+
+func (c *cgroupCollector) collectGroup(sink Sink, group string) error {
+	dir := filepath.Join(c.root, filepath.FromSlash(group))
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	labels := types.Labels{"cgroup": group}
+	set := func(name string, value float64) {
+		key := types.SeriesKey(name, labels)
+		sink.SetGauge(key, types.Gauge(value))
+		sink.Describe(repository.Gauge, name, cgroupMetadata[name])
+	}
+	add := func(name string, labels types.Labels, value uint64) {
+		c.counters.Add(sink, types.SeriesKey(name, labels), value)
+		sink.Describe(repository.Counter, name, cgroupMetadata[name])
+	}
+
+	return multierr.Combine(
+		c.collectCPU(dir, set, func(name string, value uint64) { add(name, labels, value) }),
+		c.collectMemory(dir, set, func(event string, value uint64) {
+			add("CgroupMemoryEvents", types.Labels{"cgroup": group, "event": event}, value)
+		}),
+		c.collectIO(dir, func(name, device string, value uint64) {
+			add(name, types.Labels{"cgroup": group, "device": device}, value)
+		}),
+		c.collectPids(dir, set),
+	)
+}
+
+// readCgroupFile reads the interface file of the group. Files of controllers not enabled for
+// the group are missing, so they are skipped with ok false.
+func readCgroupFile(dir, name string) (data []byte, ok bool, err error) {
+	data, err = os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// readCgroupValue reads the single value file of the group like memory.current or memory.max.
+// The value of limits is "max" if the group is not limited, then ok is false.
+func readCgroupValue(dir, name string) (value uint64, ok bool, err error) {
+	data, ok, err := readCgroupFile(dir, name)
+	if !ok {
+		return 0, false, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return 0, false, nil
+	}
+	value, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%s: %w", name, err)
+	}
+	return value, true, nil
+}
+
+// parseFlatKeyed calls fn for every "key value" line of the file like cpu.stat or memory.events.
+func parseFlatKeyed(name string, data []byte, fn func(key string, value uint64)) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", name, fields[0], err)
+		}
+		fn(fields[0], value)
+	}
+	return scanner.Err()
+}
+
+func (c *cgroupCollector) collectCPU(dir string, set func(string, float64), add func(string, uint64)) error {
+	data, ok, err := readCgroupFile(dir, "cpu.stat")
+	if ok {
+		err = parseFlatKeyed("cpu.stat", data, func(key string, value uint64) {
+			if name, ok := cpuStatCounters[key]; ok {
+				add(name, value)
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// cpu.max is "quota period" in microseconds, the quota is "max" if the group is not limited.
+	data, ok, err = readCgroupFile(dir, "cpu.max")
+	if !ok {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return nil
+	}
+	quota, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("cpu.max: %w", err)
+	}
+	period, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || period == 0 {
+		return fmt.Errorf("cpu.max: unexpected format %q", data)
+	}
+	set("CgroupCPULimit", float64(quota)/float64(period))
+	return nil
+}
+
+func (c *cgroupCollector) collectMemory(dir string, set func(string, float64), add func(string, uint64)) error {
+	usage, ok, err := readCgroupValue(dir, "memory.current")
+	if err != nil || !ok {
+		return err
+	}
+	set("CgroupMemoryUsage", float64(usage))
+	limit, ok, err := readCgroupValue(dir, "memory.max")
+	if err != nil {
+		return err
+	}
+	if ok && limit > 0 {
+		set("CgroupMemoryLimit", float64(limit))
+		set("CgroupMemoryUtilization", float64(usage)/float64(limit))
+	}
+
+	data, ok, err := readCgroupFile(dir, "memory.events")
+	if !ok {
+		return err
+	}
+	return parseFlatKeyed("memory.events", data, add)
+}
+
+func (c *cgroupCollector) collectIO(dir string, add func(name, device string, value uint64)) error {
+	data, ok, err := readCgroupFile(dir, "io.stat")
+	if !ok {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Lines look like "8:0 rbytes=4096 wbytes=0 rios=1 wios=0 dbytes=0 dios=0".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		for _, field := range fields[1:] {
+			key, v, _ := strings.Cut(field, "=")
+			name, known := ioStatCounters[key]
+			if !known {
+				continue
+			}
+			value, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("io.stat %s: %w", key, err)
+			}
+			add(name, fields[0], value)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *cgroupCollector) collectPids(dir string, set func(string, float64)) error {
+	current, ok, err := readCgroupValue(dir, "pids.current")
+	if err != nil || !ok {
+		return err
+	}
+	set("CgroupPids", float64(current))
+	limit, ok, err := readCgroupValue(dir, "pids.max")
+	if ok {
+		set("CgroupPidsLimit", float64(limit))
+	}
+	return err
+}
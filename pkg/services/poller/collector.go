@@ -0,0 +1,164 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+	"github.com/ASRafalsky/telemetry/pkg/services/sink"
+)
+
+// Sink receives metrics from collectors, see sink.Sink.
+type Sink = sink.Sink
+
+// Collector collects metrics into the sink every Interval.
+type Collector interface {
+	Name() string
+	Interval() time.Duration
+	Collect(ctx context.Context, sink Sink) error
+}
+
+// Config configures a collector created by the registry.
+type Config struct {
+	Interval time.Duration
+	// Params are collector specific settings.
+	Params map[string]string
+}
+
+// Factory creates a collector.
+type Factory func(cfg Config) (Collector, error)
+
+var registry = struct {
+	mx        sync.RWMutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+// Register makes the collector available by name. It panics if the name is already registered.
+func Register(name string, factory Factory) {
+	registry.mx.Lock()
+	defer registry.mx.Unlock()
+
+	if _, ok := registry.factories[name]; ok {
+		panic("poller: collector " + name + " is already registered")
+	}
+	registry.factories[name] = factory
+}
+
+// Registered returns sorted names of the registered collectors.
+func Registered() []string {
+	registry.mx.RLock()
+	defer registry.mx.RUnlock()
+
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewCollector creates the registered collector.
+func NewCollector(name string, cfg Config) (Collector, error) {
+	registry.mx.RLock()
+	factory, ok := registry.factories[name]
+	registry.mx.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown collector %q, expected one of %v", name, Registered())
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("collector %s: interval must be positive", name)
+	}
+	return factory(cfg)
+}
+
+// NewSink returns Sink which stores metrics in the repositories.
+func NewSink(repos map[string]repository.Repository) Sink {
+	return sink.New(repos)
+}
+
+// gaugeSeries removes gauges which were set by the previous poll of a collector but not by the current one,
+// e.g. of finished processes. A poll sets gauges through the sink returned by track and calls sweep at the end.
+type gaugeSeries struct {
+	prev, cur map[string]struct{}
+}
+
+// track starts the poll and returns the sink which records gauges set through it.
+func (g *gaugeSeries) track(sink Sink) Sink {
+	g.cur = make(map[string]struct{})
+	return &trackingSink{Sink: sink, set: g.cur}
+}
+
+// keep keeps gauges of the previous poll matching fn, e.g. of an endpoint which is unavailable for a while.
+func (g *gaugeSeries) keep(fn func(key string) bool) {
+	for key := range g.prev {
+		if fn(key) {
+			g.cur[key] = struct{}{}
+		}
+	}
+}
+
+// sweep removes gauges of the previous poll which are neither set by the current one nor kept.
+func (g *gaugeSeries) sweep(sink Sink) {
+	for key := range g.prev {
+		if _, ok := g.cur[key]; !ok {
+			sink.RemoveGauge(key)
+		}
+	}
+	g.prev, g.cur = g.cur, nil
+}
+
+// trackingSink records keys of the gauges set through it.
+type trackingSink struct {
+	Sink
+	set map[string]struct{}
+}
+
+func (s *trackingSink) SetGauge(name string, value types.Gauge) {
+	s.Sink.SetGauge(name, value)
+	s.set[name] = struct{}{}
+}
+
+// Counters converts cumulative totals read by collectors to the deltas taken by Sink.AddCounter.
+// The first total of a series is the whole delta. A total lower than the previous one means the source
+// was reset, e.g. a process or a group was recreated, so the whole total is the delta as well.
+// Deltas above math.MaxInt64 are clamped. The zero value is ready to use, it isn't safe for concurrent use.
+type Counters struct {
+	totals map[string]uint64
+}
+
+// Add adds the delta of the total since the previous call to the counter key.
+func (c *Counters) Add(sink Sink, key string, total uint64) {
+	sink.AddCounter(key, types.Counter(min(c.Delta(key, total), math.MaxInt64)))
+}
+
+// Delta returns the delta of the total since the previous call for key and remembers the total.
+func (c *Counters) Delta(key string, total uint64) uint64 {
+	if c.totals == nil {
+		c.totals = make(map[string]uint64)
+	}
+	prev, ok := c.totals[key]
+	c.totals[key] = total
+	if !ok || total < prev {
+		return total
+	}
+	return total - prev
+}
+
+// FloatTotal converts the float total, e.g. of an exposed counter, to the integer one taken by Add.
+// The fraction is dropped from the total rather than from every delta, so it isn't lost over time.
+func FloatTotal(total float64) uint64 {
+	switch {
+	case !(total > 0):
+		return 0
+	case total >= math.MaxUint64:
+		return math.MaxUint64
+	default:
+		return uint64(total)
+	}
+}
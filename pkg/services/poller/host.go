@@ -0,0 +1,191 @@
+package poller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+const procRoot = "/proc"
+
+func init() {
+	Register("host", func(cfg Config) (Collector, error) {
+		root := procRoot
+		if v, ok := cfg.Params["root"]; ok {
+			root = v
+		}
+		return newHostCollector(root, cfg.Interval), nil
+	})
+}
+
+// cpuTimes are cumulative CPU times of a core in clock ticks.
+type cpuTimes struct {
+	idle  uint64
+	total uint64
+}
+
+// hostCollector collects memory, CPU, load average and uptime of the host from procfs mounted at root.
+type hostCollector struct {
+	root     string
+	interval time.Duration
+	// cpus keeps times of the previous poll, since utilization is measured between polls.
+	cpus map[string]cpuTimes
+}
+
+func newHostCollector(root string, interval time.Duration) *hostCollector {
+	return &hostCollector{root: root, interval: interval, cpus: make(map[string]cpuTimes)}
+}
+
+func (h *hostCollector) Name() string {
+	return "host"
+}
+
+func (h *hostCollector) Interval() time.Duration {
+	return h.interval
+}
+
+func (h *hostCollector) Collect(_ context.Context, sink Sink) error {
+	return multierr.Combine(
+		h.collectMemory(sink),
+		h.collectCPU(sink),
+		h.collectLoad(sink),
+		h.collectUptime(sink),
+	)
+}
+
+// set stores the gauge with its metadata.
+func (h *hostCollector) set(sink Sink, name string, value float64, md types.Metadata) {
+	sink.SetGauge(name, types.Gauge(value))
+	sink.Describe(repository.Gauge, name, md)
+}
+
+func (h *hostCollector) collectMemory(sink Sink) error {
+	data, err := os.ReadFile(filepath.Join(h.root, "meminfo"))
+	if err != nil {
+		return err
+	}
+	names := map[string]string{"MemTotal": "TotalMemory", "MemFree": "FreeMemory"}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Lines look like "MemTotal:       16318412 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, ok := names[strings.TrimSuffix(fields[0], ":")]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("meminfo %s: %w", fields[0], err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		h.set(sink, name, float64(value), hostMetadata[name])
+	}
+	return scanner.Err()
+}
+
+func (h *hostCollector) collectCPU(sink Sink) error {
+	data, err := os.ReadFile(filepath.Join(h.root, "stat"))
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Per core lines look like "cpu0 user nice system idle iowait irq softirq steal guest guest_nice",
+		// the line of all cores is "cpu  ..." and it is skipped.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] == "cpu" || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		core, err := strconv.Atoi(strings.TrimPrefix(fields[0], "cpu"))
+		if err != nil {
+			continue
+		}
+
+		var times cpuTimes
+		// Guest time is already included into user time.
+		for i, field := range fields[1:min(len(fields), 9)] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return fmt.Errorf("stat %s: %w", fields[0], err)
+			}
+			times.total += value
+			// Idle and iowait.
+			if i == 3 || i == 4 {
+				times.idle += value
+			}
+		}
+
+		prev, ok := h.cpus[fields[0]]
+		h.cpus[fields[0]] = times
+		if !ok || times.total <= prev.total {
+			continue
+		}
+		// Iowait of a core may decrease, so the idle time is clamped to keep utilization within 0 and 100.
+		total := times.total - prev.total
+		var idle uint64
+		if times.idle > prev.idle {
+			idle = min(times.idle-prev.idle, total)
+		}
+		h.set(sink, "CPUutilization"+strconv.Itoa(core+1), 100*float64(total-idle)/float64(total),
+			types.Metadata{
+				Description: fmt.Sprintf("Utilization of CPU core %d since the previous poll.", core),
+				Unit:        "percent",
+				Owner:       metadataOwner,
+			})
+	}
+	return scanner.Err()
+}
+
+func (h *hostCollector) collectLoad(sink Sink) error {
+	data, err := os.ReadFile(filepath.Join(h.root, "loadavg"))
+	if err != nil {
+		return err
+	}
+	// The file looks like "0.52 0.58 0.59 1/1234 5678".
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("loadavg: unexpected format %q", data)
+	}
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		value, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("loadavg: %w", err)
+		}
+		h.set(sink, name, value, hostMetadata[name])
+	}
+	return nil
+}
+
+func (h *hostCollector) collectUptime(sink Sink) error {
+	data, err := os.ReadFile(filepath.Join(h.root, "uptime"))
+	if err != nil {
+		return err
+	}
+	// The file looks like "12345.67 23456.78", the first value is the uptime.
+	fields := strings.Fields(string(data))
+	if len(fields) < 1 {
+		return fmt.Errorf("uptime: unexpected format %q", data)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return fmt.Errorf("uptime: %w", err)
+	}
+	h.set(sink, "Uptime", value, hostMetadata["Uptime"])
+	return nil
+}
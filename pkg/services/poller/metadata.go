@@ -0,0 +1,85 @@
+package poller
+
+import (
+	"github.com/ASRafalsky/telemetry/internal/types"
+)
+
+const metadataOwner = "agent"
+
+// gaugeMetadata describes gauges collected by getGaugeMetrics, see runtime.MemStats for details.
+var gaugeMetadata = map[string]types.Metadata{
+	"Alloc":         {Description: "Bytes of allocated heap objects.", Unit: "bytes", Owner: metadataOwner},
+	"BuckHashSys":   {Description: "Bytes of memory in profiling bucket hash tables.", Unit: "bytes", Owner: metadataOwner},
+	"Frees":         {Description: "Cumulative count of heap objects freed.", Unit: "objects", Owner: metadataOwner},
+	"GCCPUFraction": {Description: "Fraction of available CPU time used by the GC since the program started.", Unit: "ratio", Owner: metadataOwner},
+	"GCSys":         {Description: "Bytes of memory in garbage collection metadata.", Unit: "bytes", Owner: metadataOwner},
+	"HeapAlloc":     {Description: "Bytes of allocated heap objects.", Unit: "bytes", Owner: metadataOwner},
+	"HeapIdle":      {Description: "Bytes in idle (unused) heap spans.", Unit: "bytes", Owner: metadataOwner},
+	"HeapInuse":     {Description: "Bytes in in-use heap spans.", Unit: "bytes", Owner: metadataOwner},
+	"HeapObjects":   {Description: "Number of allocated heap objects.", Unit: "objects", Owner: metadataOwner},
+	"HeapReleased":  {Description: "Bytes of physical memory returned to the OS.", Unit: "bytes", Owner: metadataOwner},
+	"HeapSys":       {Description: "Bytes of heap memory obtained from the OS.", Unit: "bytes", Owner: metadataOwner},
+	"LastGC":        {Description: "Time the last garbage collection finished, since the Unix epoch.", Unit: "nanoseconds", Owner: metadataOwner},
+	"Lookups":       {Description: "Number of pointer lookups performed by the runtime.", Unit: "lookups", Owner: metadataOwner},
+	"MCacheInuse":   {Description: "Bytes of allocated mcache structures.", Unit: "bytes", Owner: metadataOwner},
+	"MCacheSys":     {Description: "Bytes of memory obtained from the OS for mcache structures.", Unit: "bytes", Owner: metadataOwner},
+	"MSpanInuse":    {Description: "Bytes of allocated mspan structures.", Unit: "bytes", Owner: metadataOwner},
+	"MSpanSys":      {Description: "Bytes of memory obtained from the OS for mspan structures.", Unit: "bytes", Owner: metadataOwner},
+	"Mallocs":       {Description: "Cumulative count of heap objects allocated.", Unit: "objects", Owner: metadataOwner},
+	"NextGC":        {Description: "Target heap size of the next GC cycle.", Unit: "bytes", Owner: metadataOwner},
+	"NumForcedGC":   {Description: "Number of GC cycles that were forced by the application.", Unit: "cycles", Owner: metadataOwner},
+	"NumGC":         {Description: "Number of completed GC cycles.", Unit: "cycles", Owner: metadataOwner},
+	"OtherSys":      {Description: "Bytes of memory in miscellaneous off-heap runtime allocations.", Unit: "bytes", Owner: metadataOwner},
+	"PauseTotalNs":  {Description: "Cumulative time spent in GC stop-the-world pauses.", Unit: "nanoseconds", Owner: metadataOwner},
+	"StackInuse":    {Description: "Bytes in stack spans.", Unit: "bytes", Owner: metadataOwner},
+	"StackSys":      {Description: "Bytes of stack memory obtained from the OS.", Unit: "bytes", Owner: metadataOwner},
+	"Sys":           {Description: "Total bytes of memory obtained from the OS.", Unit: "bytes", Owner: metadataOwner},
+	"TotalAlloc":    {Description: "Cumulative bytes allocated for heap objects.", Unit: "bytes", Owner: metadataOwner},
+	"RandomValue":   {Description: "Random value in [0.0, 1.0), changes on every poll.", Unit: "ratio", Owner: metadataOwner},
+}
+
+// counterMetadata describes counters collected by getCounterMetrics.
+var counterMetadata = map[string]types.Metadata{
+	"PollCount": {Description: "Number of polls performed by the agent.", Unit: "polls", Owner: metadataOwner},
+}
+
+// hostMetadata describes gauges collected by hostCollector, CPU utilization is described per core.
+var hostMetadata = map[string]types.Metadata{
+	"TotalMemory":   {Description: "Total usable memory of the host.", Unit: "bytes", Owner: metadataOwner},
+	"FreeMemory":    {Description: "Unused memory of the host.", Unit: "bytes", Owner: metadataOwner},
+	"LoadAverage1":  {Description: "Host load average over 1 minute.", Unit: "processes", Owner: metadataOwner},
+	"LoadAverage5":  {Description: "Host load average over 5 minutes.", Unit: "processes", Owner: metadataOwner},
+	"LoadAverage15": {Description: "Host load average over 15 minutes.", Unit: "processes", Owner: metadataOwner},
+	"Uptime":        {Description: "Time since the host boot.", Unit: "seconds", Owner: metadataOwner},
+}
+
+// processMetadata describes gauges collected by processCollector.
+var processMetadata = map[string]types.Metadata{
+	"ProcessCPUSeconds": {Description: "Cumulative user and system CPU time of the process.", Unit: "seconds", Owner: metadataOwner},
+	"ProcessRSS":        {Description: "Resident set size of the process.", Unit: "bytes", Owner: metadataOwner},
+	"ProcessThreads":    {Description: "Number of threads of the process.", Unit: "threads", Owner: metadataOwner},
+	"ProcessOpenFDs":    {Description: "Number of open file descriptors of the process.", Unit: "descriptors", Owner: metadataOwner},
+	"ProcessReadBytes":  {Description: "Cumulative bytes read by the process from storage.", Unit: "bytes", Owner: metadataOwner},
+	"ProcessWriteBytes": {Description: "Cumulative bytes written by the process to storage.", Unit: "bytes", Owner: metadataOwner},
+}
+
+// cgroupMetadata describes metrics collected by cgroupCollector.
+var cgroupMetadata = map[string]types.Metadata{
+	"CgroupCPUUsageMicroseconds":     {Description: "Cumulative CPU time of the cgroup.", Unit: "microseconds", Owner: metadataOwner},
+	"CgroupCPUUserMicroseconds":      {Description: "Cumulative user CPU time of the cgroup.", Unit: "microseconds", Owner: metadataOwner},
+	"CgroupCPUSystemMicroseconds":    {Description: "Cumulative system CPU time of the cgroup.", Unit: "microseconds", Owner: metadataOwner},
+	"CgroupCPUPeriods":               {Description: "Enforcement periods of the CPU limit of the cgroup.", Unit: "periods", Owner: metadataOwner},
+	"CgroupCPUThrottledPeriods":      {Description: "Periods the cgroup was throttled by the CPU limit.", Unit: "periods", Owner: metadataOwner},
+	"CgroupCPUThrottledMicroseconds": {Description: "Cumulative time the cgroup was throttled by the CPU limit.", Unit: "microseconds", Owner: metadataOwner},
+	"CgroupCPULimit":                 {Description: "CPU limit of the cgroup.", Unit: "cores", Owner: metadataOwner},
+	"CgroupMemoryUsage":              {Description: "Memory used by the cgroup.", Unit: "bytes", Owner: metadataOwner},
+	"CgroupMemoryLimit":              {Description: "Memory limit of the cgroup.", Unit: "bytes", Owner: metadataOwner},
+	"CgroupMemoryUtilization":        {Description: "Memory used by the cgroup relative to its limit.", Unit: "ratio", Owner: metadataOwner},
+	"CgroupMemoryEvents":             {Description: "Memory events of the cgroup like oom_kill, by event.", Unit: "events", Owner: metadataOwner},
+	"CgroupIOReadBytes":              {Description: "Cumulative bytes read by the cgroup, by device.", Unit: "bytes", Owner: metadataOwner},
+	"CgroupIOWriteBytes":             {Description: "Cumulative bytes written by the cgroup, by device.", Unit: "bytes", Owner: metadataOwner},
+	"CgroupIOReads":                  {Description: "Cumulative read operations of the cgroup, by device.", Unit: "operations", Owner: metadataOwner},
+	"CgroupIOWrites":                 {Description: "Cumulative write operations of the cgroup, by device.", Unit: "operations", Owner: metadataOwner},
+	"CgroupPids":                     {Description: "Number of processes in the cgroup.", Unit: "processes", Owner: metadataOwner},
+	"CgroupPidsLimit":                {Description: "Process limit of the cgroup.", Unit: "processes", Owner: metadataOwner},
+}
@@ -3,78 +3,172 @@ package poller
 import (
 	"context"
 	"fmt"
-	"math/rand/v2"
-	"runtime"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/ASRafalsky/telemetry/internal/types"
 	"github.com/ASRafalsky/telemetry/pkg/services/repository"
 )
 
-func Poll(ctx context.Context, interval time.Duration, repos map[string]repository.Repository) {
-	fmt.Printf("Polling started with interval %v\n", interval)
-	pollTimer := time.NewTicker(interval)
-	defer pollTimer.Stop()
+// Stats are counters of the collectors, they are safe for concurrent use.
+type Stats struct {
+	mx         sync.Mutex
+	collectors map[string]*CollectorStats
+}
 
-	for ctx.Err() == nil {
+// CollectorStats are counters of a single collector.
+type CollectorStats struct {
+	Name   string
+	Polls  int64
+	Errors int64
+	// Duration is the duration of the last poll.
+	Duration time.Duration
+}
+
+// Collectors returns counters of all collectors which have been polled, sorted by name.
+func (s *Stats) Collectors() []CollectorStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	res := make([]CollectorStats, 0, len(s.collectors))
+	for _, cs := range s.collectors {
+		res = append(res, *cs)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func (s *Stats) observe(name string, d time.Duration, err error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.collectors == nil {
+		s.collectors = make(map[string]*CollectorStats)
+	}
+	cs, ok := s.collectors[name]
+	if !ok {
+		cs = &CollectorStats{Name: name}
+		s.collectors[name] = cs
+	}
+	cs.Polls++
+	if err != nil {
+		cs.Errors++
+	}
+	cs.Duration = d
+}
+
+// Poll runs every collector in its own goroutine with its interval until ctx is done.
+func Poll(ctx context.Context, repos map[string]repository.Repository, collectors ...Collector) {
+	PollWithReload(ctx, repos, nil, nil, collectors...)
+}
+
+// PollWithReload is Poll which replaces the running collectors by the ones received from reload.
+// Collectors received again keep running, the others are stopped or started. Collected values are kept
+// in the repositories, so counters are not lost. Polls are counted in stats if it is not nil.
+func PollWithReload(ctx context.Context, repos map[string]repository.Repository, reload <-chan []Collector,
+	stats *Stats, collectors ...Collector) {
+	sink := NewSink(repos)
+
+	type task struct {
+		Collector
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	running := make(map[string]*task)
+	stop := func(t *task) {
+		t.cancel()
+		<-t.done
+	}
+	apply := func(collectors []Collector) {
+		next := make(map[string]Collector, len(collectors))
+		for _, c := range collectors {
+			next[c.Name()] = c
+		}
+		for name, t := range running {
+			if c, ok := next[name]; !ok || c != t.Collector {
+				stop(t)
+				delete(running, name)
+				fmt.Printf("Polling %s stopped\n", name)
+			}
+		}
+		for name, c := range next {
+			if _, ok := running[name]; ok {
+				continue
+			}
+			taskCtx, cancel := context.WithCancel(ctx)
+			t := &task{Collector: c, cancel: cancel, done: make(chan struct{})}
+			go func() {
+				defer close(t.done)
+				run(taskCtx, c, sink, stats)
+			}()
+			running[name] = t
+		}
+	}
+
+	apply(collectors)
+	for {
 		select {
 		case <-ctx.Done():
-			return
-		case <-pollTimer.C:
-			for name := range repos {
-				switch name {
-				case repository.Gauge:
-					getGaugeMetrics(repos[name])
-				case repository.Counter:
-					getCounterMetrics(repos[name])
-				default:
-				}
+			for _, t := range running {
+				stop(t)
 			}
+			return
+		case collectors := <-reload:
+			apply(collectors)
 		}
 	}
 }
 
-func getCounterMetrics(repo repository.Repository) {
-	cnt, ok := repo.Get("PollCount")
-	if !ok {
-		repo.Set("PollCount", types.CounterToBytes(types.Counter(0)))
-		return
-	}
-	cntToSet := types.BytesToCounter(cnt)
-	cntToSet++
-	repo.Set("PollCount", types.CounterToBytes(cntToSet))
+// Aligned makes the collector poll at multiples of its interval on the wall clock, e.g. at :00, :10, :20
+// seconds for the 10 seconds interval, so samples of all agents are taken at the same time.
+func Aligned(c Collector) Collector {
+	return aligned{c}
+}
+
+// aligned is comparable, so the collector keeps running on reload while it is aligned.
+type aligned struct {
+	Collector
 }
 
-func getGaugeMetrics(repo repository.Repository) {
-	memStats := runtime.MemStats{}
-	runtime.ReadMemStats(&memStats)
+func run(ctx context.Context, c Collector, sink Sink, stats *Stats) {
+	_, align := c.(aligned)
+	fmt.Printf("Polling %s started with interval %v, aligned %t\n", c.Name(), c.Interval(), align)
+	collect := func() {
+		start := time.Now()
+		err := c.Collect(ctx, sink)
+		if stats != nil {
+			stats.observe(c.Name(), time.Since(start), err)
+		}
+		if err != nil {
+			fmt.Printf("[poll/%s] Failed to collect data; %s\n", c.Name(), err)
+		}
+	}
+	var pollTimer *time.Ticker
+	if align {
+		// The ticker started at the boundary before the first poll keeps the polls aligned however long it takes.
+		wait := time.NewTimer(untilAligned(time.Now(), c.Interval()))
+		defer wait.Stop()
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait.C:
+			pollTimer = time.NewTicker(c.Interval())
+			collect()
+		}
+	} else {
+		pollTimer = time.NewTicker(c.Interval())
+	}
+	defer pollTimer.Stop()
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pollTimer.C:
+			collect()
+		}
+	}
+}
 
-	repo.Set("Alloc", types.GaugeToBytes(types.Gauge(memStats.Alloc)))
-	repo.Set("BuckHashSys", types.GaugeToBytes(types.Gauge(memStats.BuckHashSys)))
-	repo.Set("Frees", types.GaugeToBytes(types.Gauge(memStats.Frees)))
-	repo.Set("GCCPUFraction", types.GaugeToBytes(types.Gauge(memStats.GCCPUFraction)))
-	repo.Set("GCSys", types.GaugeToBytes(types.Gauge(memStats.GCSys)))
-	repo.Set("HeapAlloc", types.GaugeToBytes(types.Gauge(memStats.HeapAlloc)))
-	repo.Set("HeapIdle", types.GaugeToBytes(types.Gauge(memStats.HeapIdle)))
-	repo.Set("HeapInuse", types.GaugeToBytes(types.Gauge(memStats.HeapInuse)))
-	repo.Set("HeapObjects", types.GaugeToBytes(types.Gauge(memStats.HeapObjects)))
-	repo.Set("HeapReleased", types.GaugeToBytes(types.Gauge(memStats.HeapReleased)))
-	repo.Set("HeapSys", types.GaugeToBytes(types.Gauge(memStats.HeapSys)))
-	repo.Set("LastGC", types.GaugeToBytes(types.Gauge(memStats.LastGC)))
-	repo.Set("Lookups", types.GaugeToBytes(types.Gauge(memStats.Lookups)))
-	repo.Set("MCacheInuse", types.GaugeToBytes(types.Gauge(memStats.MCacheInuse)))
-	repo.Set("MCacheSys", types.GaugeToBytes(types.Gauge(memStats.MCacheSys)))
-	repo.Set("MSpanInuse", types.GaugeToBytes(types.Gauge(memStats.MSpanInuse)))
-	repo.Set("MSpanSys", types.GaugeToBytes(types.Gauge(memStats.MSpanSys)))
-	repo.Set("Mallocs", types.GaugeToBytes(types.Gauge(memStats.Mallocs)))
-	repo.Set("NextGC", types.GaugeToBytes(types.Gauge(memStats.NextGC)))
-	repo.Set("NumForcedGC", types.GaugeToBytes(types.Gauge(memStats.NumForcedGC)))
-	repo.Set("NumGC", types.GaugeToBytes(types.Gauge(memStats.NumGC)))
-	repo.Set("OtherSys", types.GaugeToBytes(types.Gauge(memStats.OtherSys)))
-	repo.Set("PauseTotalNs", types.GaugeToBytes(types.Gauge(memStats.PauseTotalNs)))
-	repo.Set("StackInuse", types.GaugeToBytes(types.Gauge(memStats.StackInuse)))
-	repo.Set("StackSys", types.GaugeToBytes(types.Gauge(memStats.StackSys)))
-	repo.Set("Sys", types.GaugeToBytes(types.Gauge(memStats.Sys)))
-	repo.Set("TotalAlloc", types.GaugeToBytes(types.Gauge(memStats.TotalAlloc)))
-	repo.Set("RandomValue", types.GaugeToBytes(types.Gauge(rand.Float64())))
+// untilAligned returns the time left until the next multiple of the interval.
+func untilAligned(now time.Time, interval time.Duration) time.Duration {
+	return now.Truncate(interval).Add(interval).Sub(now)
 }
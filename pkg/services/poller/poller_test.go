@@ -2,6 +2,17 @@ package poller
 
 import (
 	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,12 +23,41 @@ import (
 	"github.com/ASRafalsky/telemetry/pkg/services/repository"
 )
 
+// gaugeValue returns the gauge of the series, ok is false if it is missing.
+func gaugeValue(repos map[string]repository.Repository, name string, labels types.Labels) (float64, bool) {
+	value, ok := repos[repository.Gauge].Get(types.SeriesKey(name, labels))
+	if !ok {
+		return 0, false
+	}
+	return float64(types.BytesToGauge(value)), true
+}
+
+// counterValue returns the counter of the series, the test fails if it is missing.
+func counterValue(t *testing.T, repos map[string]repository.Repository, name string, labels types.Labels) int64 {
+	t.Helper()
+	value, ok := repos[repository.Counter].Get(types.SeriesKey(name, labels))
+	require.True(t, ok, name, labels)
+	return int64(types.BytesToCounter(value))
+}
+
+// writeFiles writes the files with the data to dir, names may contain subdirectories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	}
+}
+
 func TestGetMetrics(t *testing.T) {
 	repos := repository.NewRepositories()
+	sink := NewSink(repos)
 
 	t.Run("getCounterMetrics", func(t *testing.T) {
+		c := &runtimeCollector{}
 		for i := range 10 {
-			getCounterMetrics(repos[repository.Counter])
+			c.getCounterMetrics(sink)
 			value, ok := repos[repository.Counter].Get("PollCount")
 			assert.True(t, ok)
 			assert.Equal(t, types.Counter(i), types.BytesToCounter(value), i)
@@ -27,7 +67,7 @@ func TestGetMetrics(t *testing.T) {
 	t.Run("getGaugeMetrics", func(t *testing.T) {
 		var previousValue types.Gauge
 		for range 10 {
-			getGaugeMetrics(repos[repository.Gauge])
+			getGaugeMetrics(sink)
 			value, ok := repos[repository.Gauge].Get("RandomValue")
 			assert.True(t, ok)
 			gaugeValue := types.BytesToGauge(value)
@@ -36,13 +76,30 @@ func TestGetMetrics(t *testing.T) {
 			previousValue = gaugeValue
 		}
 	})
+
+	t.Run("getMetadata", func(t *testing.T) {
+		getMetadata(sink)
+		for name, repo := range map[string]repository.Repository{
+			repository.Gauge:   repos[repository.Gauge],
+			repository.Counter: repos[repository.Counter],
+		} {
+			require.NoError(t, repo.ForEach(context.Background(), func(k string, _ []byte) error {
+				value, ok := repos[repository.Metadata].Get(repository.MetadataKey(name, k))
+				assert.True(t, ok, k)
+				assert.NotEmpty(t, types.BytesToMetadata(value).Unit, k)
+				return nil
+			}))
+		}
+	})
 }
 
 func TestPoll(t *testing.T) {
 	repos := repository.NewRepositories()
 	ctx, cancel := context.WithCancel(context.Background())
 
-	go Poll(ctx, 100*time.Millisecond, repos)
+	c, err := NewCollector("runtime", Config{Interval: 100 * time.Millisecond})
+	require.NoError(t, err)
+	go Poll(ctx, repos, c)
 
 	// Wait 90 ms, it is too early to have any data.
 	time.Sleep(90 * time.Millisecond)
@@ -64,3 +121,577 @@ func TestPoll(t *testing.T) {
 
 	cancel()
 }
+
+func TestHostCollector(t *testing.T) {
+	root := t.TempDir()
+	writeProc := func(name, data string) {
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(data), 0o600))
+	}
+	writeProc("meminfo", "MemTotal:       2048 kB\nMemFree:        1024 kB\nMemAvailable:   1536 kB\n")
+	writeProc("loadavg", "0.52 0.58 0.59 1/1234 5678\n")
+	writeProc("uptime", "12345.67 23456.78\n")
+	writeProc("stat", "cpu  200 0 100 700 0 0 0 0 0 0\n"+
+		"cpu0 100 0 50 350 0 0 0 0 0 0\n"+
+		"cpu1 100 0 50 350 0 0 0 0 0 0\n"+
+		"intr 1 2 3\n")
+
+	repos := repository.NewRepositories()
+	sink := NewSink(repos)
+	h, err := NewCollector("host", Config{Interval: time.Second, Params: map[string]string{"root": root}})
+	require.NoError(t, err)
+	require.NoError(t, h.Collect(context.Background(), sink))
+
+	gauge := func(name string) (float64, bool) {
+		value, ok := repos[repository.Gauge].Get(name)
+		if !ok {
+			return 0, false
+		}
+		return float64(types.BytesToGauge(value)), true
+	}
+	for name, expected := range map[string]float64{
+		"TotalMemory":   2048 * 1024,
+		"FreeMemory":    1024 * 1024,
+		"LoadAverage1":  0.52,
+		"LoadAverage5":  0.58,
+		"LoadAverage15": 0.59,
+		"Uptime":        12345.67,
+	} {
+		value, ok := gauge(name)
+		require.True(t, ok, name)
+		assert.Equal(t, expected, value, name)
+		_, ok = repos[repository.Metadata].Get(repository.MetadataKey(repository.Gauge, name))
+		assert.True(t, ok, name)
+	}
+
+	// Utilization needs two polls.
+	_, ok := gauge("CPUutilization1")
+	require.False(t, ok)
+
+	// Core 0 is busy for 75 of 100 ticks, core 1 is idle.
+	writeProc("stat", "cpu  275 0 100 825 0 0 0 0 0 0\n"+
+		"cpu0 150 0 75 375 0 0 0 0 0 0\n"+
+		"cpu1 100 0 50 450 0 0 0 0 0 0\n")
+	require.NoError(t, h.Collect(context.Background(), sink))
+	value, ok := gauge("CPUutilization1")
+	require.True(t, ok)
+	assert.Equal(t, 75.0, value)
+	value, ok = gauge("CPUutilization2")
+	require.True(t, ok)
+	assert.Zero(t, value)
+
+	// Iowait of core 0 decreases by 30 ticks while the core is busy for 55 ticks.
+	writeProc("stat", "cpu  275 0 100 825 50 0 0 0 0 0\n"+
+		"cpu0 150 0 75 375 50 0 0 0 0 0\n"+
+		"cpu1 100 0 50 450 0 0 0 0 0 0\n")
+	require.NoError(t, h.Collect(context.Background(), sink))
+	writeProc("stat", "cpu  330 0 100 825 20 0 0 0 0 0\n"+
+		"cpu0 205 0 75 375 20 0 0 0 0 0\n"+
+		"cpu1 100 0 50 450 0 0 0 0 0 0\n")
+	require.NoError(t, h.Collect(context.Background(), sink))
+	value, ok = gauge("CPUutilization1")
+	require.True(t, ok)
+	assert.Equal(t, 100.0, value)
+
+	require.Error(t, newHostCollector(filepath.Join(root, "missing"), time.Second).Collect(context.Background(), sink))
+}
+
+func TestProcessCollector(t *testing.T) {
+	root := t.TempDir()
+	writeProcess := func(pid int, comm string, fds int) {
+		files := map[string]string{
+			"comm":   comm + "\n",
+			"stat":   strconv.Itoa(pid) + " (" + comm + ") S 1 1 1 0 -1 4194560 100 0 0 0 150 50 0 0 20 0 4 0 100\n",
+			"status": "Name:\t" + comm + "\nVmRSS:\t    2048 kB\nThreads:\t4\n",
+			"io":     "rchar: 1\nwchar: 2\nread_bytes: 4096\nwrite_bytes: 8192\n",
+		}
+		for i := range fds {
+			files[filepath.Join("fd", strconv.Itoa(i))] = ""
+		}
+		writeFiles(t, filepath.Join(root, strconv.Itoa(pid)), files)
+	}
+	writeProcess(10, "my app", 3)
+	writeProcess(20, "nginx", 1)
+	writeProcess(21, "nginx", 2)
+	writeProcess(30, "redis", 1)
+	pidDir := t.TempDir()
+	writeFiles(t, pidDir, map[string]string{"redis.pid": "30\n"})
+	pidfile := filepath.Join(pidDir, "redis.pid")
+
+	_, err := NewCollector("process", Config{Interval: time.Second, Params: map[string]string{"root": root}})
+	require.Error(t, err)
+	_, err = NewCollector("process", Config{Interval: time.Second, Params: map[string]string{"pids": "1,x"}})
+	require.Error(t, err)
+
+	repos := repository.NewRepositories()
+	sink := NewSink(repos)
+	p, err := NewCollector("process", Config{Interval: time.Second, Params: map[string]string{
+		"root": root, "pids": "10", "names": "nginx", "pidfiles": pidfile,
+	}})
+	require.NoError(t, err)
+	require.NoError(t, p.Collect(context.Background(), sink))
+
+	gauge := func(name, process string, pid int) (float64, bool) {
+		return gaugeValue(repos, name, types.Labels{"process": process, "pid": strconv.Itoa(pid)})
+	}
+	for _, proc := range []struct {
+		name string
+		pid  int
+		fds  float64
+	}{{"my app", 10, 3}, {"nginx", 20, 1}, {"nginx", 21, 2}, {"redis", 30, 1}} {
+		for name, expected := range map[string]float64{
+			"ProcessCPUSeconds": 2,
+			"ProcessRSS":        2048 * 1024,
+			"ProcessThreads":    4,
+			"ProcessOpenFDs":    proc.fds,
+			"ProcessReadBytes":  4096,
+			"ProcessWriteBytes": 8192,
+		} {
+			value, ok := gauge(name, proc.name, proc.pid)
+			require.True(t, ok, name, proc.pid)
+			assert.Equal(t, expected, value, name, proc.pid)
+			_, ok = repos[repository.Metadata].Get(repository.MetadataKey(repository.Gauge, name))
+			assert.True(t, ok, name)
+		}
+	}
+	require.Equal(t, 24, repos[repository.Gauge].Size())
+
+	// Series of finished processes are removed, missing pids are reported.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "21")))
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "10")))
+	require.Error(t, p.Collect(context.Background(), sink))
+	_, ok := gauge("ProcessRSS", "nginx", 21)
+	require.False(t, ok)
+	require.Equal(t, 12, repos[repository.Gauge].Size())
+}
+
+func TestCgroupCollector(t *testing.T) {
+	root, proc := t.TempDir(), t.TempDir()
+	writeGroup := func(group string, files map[string]string) {
+		writeFiles(t, filepath.Join(root, group), files)
+	}
+	writeGroup("app.slice/agent", map[string]string{
+		"cpu.stat":       "usage_usec 1000\nuser_usec 600\nsystem_usec 400\nnr_periods 10\nnr_throttled 2\nthrottled_usec 50\n",
+		"cpu.max":        "50000 100000\n",
+		"memory.current": "1024\n",
+		"memory.max":     "4096\n",
+		"memory.events":  "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n",
+		"io.stat":        "8:0 rbytes=4096 wbytes=8192 rios=1 wios=2 dbytes=0 dios=0\n",
+		"pids.current":   "5\n",
+		"pids.max":       "max\n",
+	})
+	// Controllers are not enabled for the other group.
+	writeGroup("other", map[string]string{"cpu.stat": "usage_usec 10\n"})
+	writeFiles(t, proc, map[string]string{"self/cgroup": "0::/app.slice/agent\n"})
+
+	repos := repository.NewRepositories()
+	sink := NewSink(repos)
+	c, err := NewCollector("cgroup", Config{Interval: time.Second, Params: map[string]string{"root": root, "proc": proc}})
+	require.NoError(t, err)
+	require.NoError(t, c.Collect(context.Background(), sink))
+
+	labels := types.Labels{"cgroup": "/app.slice/agent"}
+	gauge := func(name string) (float64, bool) {
+		return gaugeValue(repos, name, labels)
+	}
+	counter := func(name string, labels types.Labels) int64 {
+		return counterValue(t, repos, name, labels)
+	}
+	for name, expected := range map[string]float64{
+		"CgroupCPULimit":          0.5,
+		"CgroupMemoryUsage":       1024,
+		"CgroupMemoryLimit":       4096,
+		"CgroupMemoryUtilization": 0.25,
+		"CgroupPids":              5,
+	} {
+		value, ok := gauge(name)
+		require.True(t, ok, name)
+		assert.Equal(t, expected, value, name)
+		_, ok = repos[repository.Metadata].Get(repository.MetadataKey(repository.Gauge, name))
+		assert.True(t, ok, name)
+	}
+	_, ok := gauge("CgroupPidsLimit")
+	assert.False(t, ok)
+	assert.Equal(t, int64(1000), counter("CgroupCPUUsageMicroseconds", labels))
+	assert.Equal(t, int64(2), counter("CgroupCPUThrottledPeriods", labels))
+	assert.Equal(t, int64(50), counter("CgroupCPUThrottledMicroseconds", labels))
+	assert.Equal(t, int64(1), counter("CgroupMemoryEvents", types.Labels{"cgroup": "/app.slice/agent", "event": "oom_kill"}))
+	assert.Equal(t, int64(8192), counter("CgroupIOWriteBytes", types.Labels{"cgroup": "/app.slice/agent", "device": "8:0"}))
+
+	// Counters take deltas between polls, series of removed limits are removed.
+	writeGroup("app.slice/agent", map[string]string{"cpu.stat": "usage_usec 1500\n", "memory.max": "max\n"})
+	require.NoError(t, c.Collect(context.Background(), sink))
+	assert.Equal(t, int64(1500), counter("CgroupCPUUsageMicroseconds", labels))
+	_, ok = gauge("CgroupMemoryLimit")
+	assert.False(t, ok)
+	_, ok = gauge("CgroupMemoryUsage")
+	assert.True(t, ok)
+
+	c, err = NewCollector("cgroup", Config{Interval: time.Second, Params: map[string]string{
+		"root": root, "paths": "app.slice/agent,/other",
+	}})
+	require.NoError(t, err)
+	require.NoError(t, c.Collect(context.Background(), sink))
+	assert.Equal(t, int64(10), counter("CgroupCPUUsageMicroseconds", types.Labels{"cgroup": "/other"}))
+
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "other")))
+	require.Error(t, c.Collect(context.Background(), sink))
+	_, ok = gauge("CgroupMemoryUsage")
+	assert.True(t, ok)
+}
+
+func TestScrapeCollector(t *testing.T) {
+	var (
+		mx       sync.Mutex
+		exposed  string
+		failures bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		if failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = io.WriteString(w, exposed)
+	}))
+	defer srv.Close()
+	expose := func(data string, fail bool) {
+		mx.Lock()
+		defer mx.Unlock()
+		exposed, failures = data, fail
+	}
+
+	_, err := NewCollector("scrape", Config{Interval: time.Second})
+	require.Error(t, err)
+	_, err = NewCollector("scrape", Config{Interval: time.Second, Params: map[string]string{"urls": "localhost"}})
+	require.Error(t, err)
+
+	repos := repository.NewRepositories()
+	sink := NewSink(repos)
+	c, err := NewCollector("scrape", Config{Interval: time.Second, Params: map[string]string{"urls": srv.URL + "/metrics"}})
+	require.NoError(t, err)
+
+	instance := strings.TrimPrefix(srv.URL, "http://")
+	withInstance := func(labels types.Labels) types.Labels {
+		if labels == nil {
+			labels = types.Labels{}
+		}
+		labels["instance"] = instance
+		return labels
+	}
+	gauge := func(name string, labels types.Labels) (float64, bool) {
+		return gaugeValue(repos, name, withInstance(labels))
+	}
+	counter := func(name string, labels types.Labels) int64 {
+		return counterValue(t, repos, name, withInstance(labels))
+	}
+
+	expose(`# HELP http_requests_total Total HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200", path="/a\"b"} 10 1700000000000
+http_requests_total{code="500"} 2
+# TYPE queue_size gauge
+queue_size 7
+queue_size{instance="exposed"} 3
+temperature NaN
+__agent_queue_depth 1
+untyped_value 1.5
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 4
+latency_seconds_bucket{le="+Inf"} 5
+latency_seconds_sum 0.75
+latency_seconds_count 5
+`, false)
+	require.NoError(t, c.Collect(context.Background(), sink))
+
+	assert.Equal(t, int64(10), counter("http_requests_total", types.Labels{"code": "200", "path": `/a"b`}))
+	assert.Equal(t, int64(2), counter("http_requests_total", types.Labels{"code": "500"}))
+	assert.Equal(t, int64(4), counter("latency_seconds_bucket", types.Labels{"le": "0.1"}))
+	assert.Equal(t, int64(5), counter("latency_seconds_count", nil))
+	for name, expected := range map[string]float64{"queue_size": 7, "untyped_value": 1.5, "latency_seconds_sum": 0.75} {
+		value, ok := gauge(name, nil)
+		require.True(t, ok, name)
+		assert.Equal(t, expected, value, name)
+	}
+	value, ok := gauge("queue_size", types.Labels{"exported_instance": "exposed"})
+	require.True(t, ok)
+	assert.Equal(t, 3.0, value)
+	_, ok = gauge("temperature", nil)
+	require.False(t, ok)
+	_, ok = gauge("__agent_queue_depth", nil)
+	require.False(t, ok)
+	md, ok := repos[repository.Metadata].Get(repository.MetadataKey(repository.Counter, "http_requests_total"))
+	require.True(t, ok)
+	assert.Equal(t, "Total HTTP requests.", types.BytesToMetadata(md).Description)
+
+	// Counters get deltas of totals, the reset takes the whole total. Series of the failed endpoint are kept.
+	expose("", true)
+	require.Error(t, c.Collect(context.Background(), sink))
+	_, ok = gauge("queue_size", nil)
+	require.True(t, ok)
+
+	expose(`# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a\"b"} 15
+http_requests_total{code="500"} 1
+`, false)
+	require.NoError(t, c.Collect(context.Background(), sink))
+	assert.Equal(t, int64(15), counter("http_requests_total", types.Labels{"code": "200", "path": `/a"b`}))
+	assert.Equal(t, int64(3), counter("http_requests_total", types.Labels{"code": "500"}))
+	_, ok = gauge("queue_size", nil)
+	require.False(t, ok)
+}
+
+func TestCounters(t *testing.T) {
+	var c Counters
+	for _, tt := range []struct {
+		name         string
+		total, delta uint64
+	}{
+		{name: "first total", total: 10, delta: 10},
+		{name: "increase", total: 15, delta: 5},
+		{name: "no change", total: 15, delta: 0},
+		{name: "reset", total: 4, delta: 4},
+		{name: "after reset", total: 6, delta: 2},
+	} {
+		assert.Equal(t, tt.delta, c.Delta("total", tt.total), tt.name)
+	}
+
+	repos := repository.NewRepositories()
+	c.Add(NewSink(repos), "huge", math.MaxUint64)
+	assert.Equal(t, int64(math.MaxInt64), counterValue(t, repos, "huge", nil))
+
+	for value, expected := range map[float64]uint64{-1: 0, math.NaN(): 0, 2.9: 2, 1e30: math.MaxUint64} {
+		assert.Equal(t, expected, FloatTotal(value), value)
+	}
+}
+
+func TestRuntimeMetricsCollector(t *testing.T) {
+	require.Equal(t, "go_sched_goroutines_goroutines", runtimeMetricName("/sched/goroutines:goroutines"))
+	require.Equal(t, "go_gc_cycles_total_gc_cycles", runtimeMetricName("/gc/cycles/total:gc-cycles"))
+
+	repos := repository.NewRepositories()
+	sink := NewSink(repos)
+	c, err := NewCollector("runtime_metrics", Config{Interval: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, c.Collect(context.Background(), sink))
+	counter := func(name string) int64 {
+		return counterValue(t, repos, name, nil)
+	}
+	cycles := counter("go_gc_cycles_total_gc_cycles")
+	pauses := counter("go_sched_pauses_total_gc_seconds_count")
+
+	// GC pauses are taken since the previous poll, counters get deltas.
+	runtime.GC()
+	require.NoError(t, c.Collect(context.Background(), sink))
+	require.Greater(t, counter("go_gc_cycles_total_gc_cycles"), cycles)
+	require.Greater(t, counter("go_sched_pauses_total_gc_seconds_count"), pauses)
+	for _, q := range []string{"0.5", "0.9", "0.99", "1"} {
+		_, ok := repos[repository.Gauge].Get(types.SeriesKey("go_sched_pauses_total_gc_seconds", types.Labels{"quantile": q}))
+		require.True(t, ok, q)
+	}
+	_, ok := repos[repository.Gauge].Get(types.SeriesKey("go_sched_latencies_seconds", types.Labels{"quantile": "0.99"}))
+	require.True(t, ok)
+
+	goroutines, ok := gaugeValue(repos, "go_sched_goroutines_goroutines", nil)
+	require.True(t, ok)
+	require.Positive(t, goroutines)
+	md, ok := repos[repository.Metadata].Get(repository.MetadataKey(repository.Gauge, "go_sched_goroutines_goroutines"))
+	require.True(t, ok)
+	require.Equal(t, "goroutines", types.BytesToMetadata(md).Unit)
+
+	// Quantiles are removed once there are no new samples.
+	h := &metrics.Float64Histogram{Counts: []uint64{1, 3}, Buckets: []float64{0, 1, 2}}
+	median := types.Labels{"quantile": "0.5"}
+	c.(*runtimeMetricsCollector).collectHistogram("/test:seconds", "test_seconds", h, sink)
+	value, ok := gaugeValue(repos, "test_seconds", median)
+	require.True(t, ok)
+	require.Equal(t, float64(2), value)
+	c.(*runtimeMetricsCollector).collectHistogram("/test:seconds", "test_seconds", h, sink)
+	_, ok = gaugeValue(repos, "test_seconds", median)
+	require.False(t, ok)
+}
+
+type testCollector struct{}
+
+func (c *testCollector) Name() string {
+	return "test"
+}
+
+func (c *testCollector) Interval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (c *testCollector) Collect(_ context.Context, sink Sink) error {
+	sink.AddCounter("TestCalls", 1)
+	return nil
+}
+
+func TestRegistry(t *testing.T) {
+	require.Contains(t, Registered(), "runtime")
+	require.Contains(t, Registered(), "host")
+
+	_, err := NewCollector("unknown", Config{Interval: time.Second})
+	require.Error(t, err)
+	_, err = NewCollector("runtime", Config{})
+	require.Error(t, err)
+
+	Register("test", func(cfg Config) (Collector, error) {
+		return &testCollector{}, nil
+	})
+	t.Cleanup(func() {
+		registry.mx.Lock()
+		delete(registry.factories, "test")
+		registry.mx.Unlock()
+	})
+	require.Panics(t, func() {
+		Register("test", func(cfg Config) (Collector, error) { return nil, nil })
+	})
+	c, err := NewCollector("test", Config{Interval: time.Second})
+	require.NoError(t, err)
+
+	repos := repository.NewRepositories()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Poll(ctx, repos, c)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		value, ok := repos[repository.Counter].Get("TestCalls")
+		return ok && types.BytesToCounter(value) >= 3
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+// countCollector counts its calls in a counter named by the collector.
+type countCollector struct {
+	name string
+}
+
+func (c *countCollector) Name() string {
+	return c.name
+}
+
+func (c *countCollector) Interval() time.Duration {
+	return 10 * time.Millisecond
+}
+
+func (c *countCollector) Collect(_ context.Context, sink Sink) error {
+	sink.AddCounter(c.name, 1)
+	return nil
+}
+
+func TestPollWithReload(t *testing.T) {
+	repos := repository.NewRepositories()
+	counter := func(name string) types.Counter {
+		value, _ := repos[repository.Counter].Get(name)
+		if value == nil {
+			return 0
+		}
+		return types.BytesToCounter(value)
+	}
+
+	a, b := &countCollector{name: "a"}, &countCollector{name: "b"}
+	stats := &Stats{}
+	reload := make(chan []Collector)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		PollWithReload(ctx, repos, reload, stats, a)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return counter("a") >= 3 }, time.Second, 5*time.Millisecond)
+	require.Zero(t, counter("b"))
+
+	// The running collector keeps its counter.
+	reload <- []Collector{a, b}
+	countA := counter("a")
+	require.Eventually(t, func() bool { return counter("b") >= 3 && counter("a") > countA }, time.Second, 5*time.Millisecond)
+
+	// The disabled collector is stopped, its counter is kept. The same reload is received again only after
+	// the first one is applied.
+	reload <- []Collector{b}
+	reload <- []Collector{b}
+	countA = counter("a")
+	countB := counter("b")
+	require.Eventually(t, func() bool { return counter("b") >= countB+3 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, countA, counter("a"))
+
+	cancel()
+	<-done
+
+	// Polls of every collector are counted.
+	polled := stats.Collectors()
+	require.Len(t, polled, 2)
+	for i, name := range []string{"a", "b"} {
+		require.Equal(t, name, polled[i].Name)
+		require.Equal(t, int64(counter(name)), polled[i].Polls)
+		require.Zero(t, polled[i].Errors)
+	}
+}
+
+func TestAligned(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 7, 500_000_000, time.UTC)
+	require.Equal(t, 2500*time.Millisecond, untilAligned(now, 10*time.Second))
+	require.Equal(t, 10*time.Second, untilAligned(now.Truncate(10*time.Second), 10*time.Second))
+
+	// Aligned collectors are equal, so reload keeps them running.
+	c := &countCollector{name: "aligned"}
+	require.True(t, Aligned(c) == Aligned(c))
+	require.Equal(t, "aligned", Aligned(c).Name())
+
+	repos := repository.NewRepositories()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		Poll(ctx, repos, Aligned(c))
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		value, ok := repos[repository.Counter].Get("aligned")
+		return ok && types.BytesToCounter(value) >= 3
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
+
+// slowCollector sends poll times to polls, the first poll takes the most of the interval.
+type slowCollector struct {
+	polls chan time.Time
+	n     int
+}
+
+func (c *slowCollector) Name() string {
+	return "slow"
+}
+
+func (c *slowCollector) Interval() time.Duration {
+	return 100 * time.Millisecond
+}
+
+func (c *slowCollector) Collect(ctx context.Context, _ Sink) error {
+	select {
+	case c.polls <- time.Now():
+	case <-ctx.Done():
+	}
+	if c.n++; c.n == 1 {
+		time.Sleep(60 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestAlignedSlowPoll(t *testing.T) {
+	c := &slowCollector{polls: make(chan time.Time, 2)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Poll(ctx, repository.NewRepositories(), Aligned(c))
+
+	// The slow first poll doesn't delay the next one from the boundary.
+	for range 2 {
+		poll := <-c.polls
+		offset := poll.Sub(poll.Truncate(c.Interval()))
+		require.Less(t, offset, 30*time.Millisecond)
+	}
+}
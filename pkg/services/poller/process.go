@@ -0,0 +1,287 @@
+package poller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in procfs. It is 100 on all supported architectures.
+const clockTicks = 100
+
+func init() {
+	Register("process", func(cfg Config) (Collector, error) {
+		root := procRoot
+		if v, ok := cfg.Params["root"]; ok {
+			root = v
+		}
+		var pids []int
+		for _, v := range splitParam(cfg.Params["pids"]) {
+			pid, err := strconv.Atoi(v)
+			if err != nil || pid <= 0 {
+				return nil, fmt.Errorf("invalid pid %q", v)
+			}
+			pids = append(pids, pid)
+		}
+		c := newProcessCollector(root, cfg.Interval, pids, splitParam(cfg.Params["names"]),
+			splitParam(cfg.Params["pidfiles"]))
+		if len(c.pids)+len(c.names)+len(c.pidfiles) == 0 {
+			return nil, errors.New("pids, names or pidfiles are required")
+		}
+		return c, nil
+	})
+}
+
+// splitParam returns non-empty comma separated values of the collector parameter.
+func splitParam(param string) []string {
+	var values []string
+	for _, v := range strings.Split(param, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// processCollector collects CPU time, memory, threads, open descriptors and IO of the processes given
+// by pids, names or pidfiles from procfs mounted at root. Series are labelled by process name and pid.
+type processCollector struct {
+	root     string
+	interval time.Duration
+	pids     []int
+	// names are matched against the process command name.
+	names []string
+	// pidfiles are read on every poll, so restarted processes are followed.
+	pidfiles []string
+	// series removes gauges of finished processes.
+	series gaugeSeries
+}
+
+func newProcessCollector(root string, interval time.Duration, pids []int, names, pidfiles []string) *processCollector {
+	return &processCollector{
+		root:     root,
+		interval: interval,
+		pids:     pids,
+		names:    names,
+		pidfiles: pidfiles,
+	}
+}
+
+func (p *processCollector) Name() string {
+	return "process"
+}
+
+func (p *processCollector) Interval() time.Duration {
+	return p.interval
+}
+
+func (p *processCollector) Collect(_ context.Context, sink Sink) error {
+	pids, err := p.resolve()
+
+	tracked := p.series.track(sink)
+	for _, pid := range pids {
+		err = multierr.Append(err, p.collectProcess(tracked, pid))
+	}
+	p.series.sweep(sink)
+	return err
+}
+
+// resolve returns sorted unique pids of the configured processes.
+func (p *processCollector) resolve() ([]int, error) {
+	var errs error
+	found := make(map[int]struct{})
+	for _, pid := range p.pids {
+		found[pid] = struct{}{}
+	}
+	for _, path := range p.pidfiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("pidfile %s: %w", path, err))
+			continue
+		}
+		found[pid] = struct{}{}
+	}
+	if len(p.names) > 0 {
+		matched, err := p.findByName()
+		errs = multierr.Append(errs, err)
+		for _, pid := range matched {
+			found[pid] = struct{}{}
+		}
+	}
+
+	pids := make([]int, 0, len(found))
+	for pid := range found {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	return pids, errs
+}
+
+// findByName returns pids of all processes with one of the configured command names.
+func (p *processCollector) findByName() ([]int, error) {
+	dirs, err := os.ReadDir(p.root)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		// The process may finish while the directory is read, so errors are ignored.
+		comm, err := p.comm(pid)
+		if err != nil {
+			continue
+		}
+		for _, name := range p.names {
+			if comm == name {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+func (p *processCollector) path(pid int, name string) string {
+	return filepath.Join(p.root, strconv.Itoa(pid), name)
+}
+
+func (p *processCollector) comm(pid int) (string, error) {
+	data, err := os.ReadFile(p.path(pid, "comm"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (p *processCollector) collectProcess(sink Sink, pid int) error {
+	comm, err := p.comm(pid)
+	if err != nil {
+		return fmt.Errorf("process %d: %w", pid, err)
+	}
+	labels := types.Labels{"process": comm, "pid": strconv.Itoa(pid)}
+	set := func(name string, value float64) {
+		key := types.SeriesKey(name, labels)
+		sink.SetGauge(key, types.Gauge(value))
+		sink.Describe(repository.Gauge, name, processMetadata[name])
+	}
+
+	err = multierr.Combine(
+		p.collectStat(pid, set),
+		p.collectStatus(pid, set),
+		p.collectFDs(pid, set),
+		p.collectIO(pid, set),
+	)
+	if err != nil {
+		return fmt.Errorf("process %d: %w", pid, err)
+	}
+	return nil
+}
+
+func (p *processCollector) collectStat(pid int, set func(string, float64)) error {
+	data, err := os.ReadFile(p.path(pid, "stat"))
+	if err != nil {
+		return err
+	}
+	// The command name in parentheses may contain spaces, so fields are counted after the last ')'.
+	// utime and stime are the 14th and 15th fields, the 12th and 13th after the name.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return fmt.Errorf("stat: unexpected format %q", data)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return fmt.Errorf("stat: unexpected format %q", data)
+	}
+	var ticks uint64
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return fmt.Errorf("stat: %w", err)
+		}
+		ticks += value
+	}
+	set("ProcessCPUSeconds", float64(ticks)/clockTicks)
+	return nil
+}
+
+func (p *processCollector) collectStatus(pid int, set func(string, float64)) error {
+	data, err := os.ReadFile(p.path(pid, "status"))
+	if err != nil {
+		return err
+	}
+	names := map[string]string{"VmRSS": "ProcessRSS", "Threads": "ProcessThreads"}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Lines look like "VmRSS:	    1234 kB" or "Threads:	4", kernel threads have no VmRSS.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, ok := names[strings.TrimSuffix(fields[0], ":")]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("status %s: %w", fields[0], err)
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		set(name, float64(value))
+	}
+	return scanner.Err()
+}
+
+func (p *processCollector) collectFDs(pid int, set func(string, float64)) error {
+	fds, err := os.ReadDir(p.path(pid, "fd"))
+	if err != nil {
+		return err
+	}
+	set("ProcessOpenFDs", float64(len(fds)))
+	return nil
+}
+
+func (p *processCollector) collectIO(pid int, set func(string, float64)) error {
+	data, err := os.ReadFile(p.path(pid, "io"))
+	if err != nil {
+		return err
+	}
+	names := map[string]string{"read_bytes": "ProcessReadBytes", "write_bytes": "ProcessWriteBytes"}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		// Lines look like "read_bytes: 4096".
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		name, known := names[key]
+		if !ok || !known {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("io %s: %w", key, err)
+		}
+		set(name, float64(n))
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,91 @@
+package poller
+
+import (
+	"context"
+	"math/rand/v2"
+	"runtime"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func init() {
+	Register("runtime", func(cfg Config) (Collector, error) {
+		return &runtimeCollector{interval: cfg.Interval}, nil
+	})
+}
+
+// runtimeCollector collects runtime.MemStats of the agent process and PollCount.
+type runtimeCollector struct {
+	interval time.Duration
+	polled   bool
+}
+
+func (c *runtimeCollector) Name() string {
+	return "runtime"
+}
+
+func (c *runtimeCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *runtimeCollector) Collect(_ context.Context, sink Sink) error {
+	getGaugeMetrics(sink)
+	c.getCounterMetrics(sink)
+	getMetadata(sink)
+	return nil
+}
+
+// getCounterMetrics counts polls, the first poll sets PollCount to zero.
+func (c *runtimeCollector) getCounterMetrics(sink Sink) {
+	if !c.polled {
+		c.polled = true
+		sink.AddCounter("PollCount", 0)
+		return
+	}
+	sink.AddCounter("PollCount", 1)
+}
+
+func getGaugeMetrics(sink Sink) {
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+
+	sink.SetGauge("Alloc", types.Gauge(memStats.Alloc))
+	sink.SetGauge("BuckHashSys", types.Gauge(memStats.BuckHashSys))
+	sink.SetGauge("Frees", types.Gauge(memStats.Frees))
+	sink.SetGauge("GCCPUFraction", types.Gauge(memStats.GCCPUFraction))
+	sink.SetGauge("GCSys", types.Gauge(memStats.GCSys))
+	sink.SetGauge("HeapAlloc", types.Gauge(memStats.HeapAlloc))
+	sink.SetGauge("HeapIdle", types.Gauge(memStats.HeapIdle))
+	sink.SetGauge("HeapInuse", types.Gauge(memStats.HeapInuse))
+	sink.SetGauge("HeapObjects", types.Gauge(memStats.HeapObjects))
+	sink.SetGauge("HeapReleased", types.Gauge(memStats.HeapReleased))
+	sink.SetGauge("HeapSys", types.Gauge(memStats.HeapSys))
+	sink.SetGauge("LastGC", types.Gauge(memStats.LastGC))
+	sink.SetGauge("Lookups", types.Gauge(memStats.Lookups))
+	sink.SetGauge("MCacheInuse", types.Gauge(memStats.MCacheInuse))
+	sink.SetGauge("MCacheSys", types.Gauge(memStats.MCacheSys))
+	sink.SetGauge("MSpanInuse", types.Gauge(memStats.MSpanInuse))
+	sink.SetGauge("MSpanSys", types.Gauge(memStats.MSpanSys))
+	sink.SetGauge("Mallocs", types.Gauge(memStats.Mallocs))
+	sink.SetGauge("NextGC", types.Gauge(memStats.NextGC))
+	sink.SetGauge("NumForcedGC", types.Gauge(memStats.NumForcedGC))
+	sink.SetGauge("NumGC", types.Gauge(memStats.NumGC))
+	sink.SetGauge("OtherSys", types.Gauge(memStats.OtherSys))
+	sink.SetGauge("PauseTotalNs", types.Gauge(memStats.PauseTotalNs))
+	sink.SetGauge("StackInuse", types.Gauge(memStats.StackInuse))
+	sink.SetGauge("StackSys", types.Gauge(memStats.StackSys))
+	sink.SetGauge("Sys", types.Gauge(memStats.Sys))
+	sink.SetGauge("TotalAlloc", types.Gauge(memStats.TotalAlloc))
+	sink.SetGauge("RandomValue", types.Gauge(rand.Float64()))
+}
+
+func getMetadata(sink Sink) {
+	for name, md := range gaugeMetadata {
+		sink.Describe(repository.Gauge, name, md)
+	}
+	for name, md := range counterMetadata {
+		sink.Describe(repository.Counter, name, md)
+	}
+}
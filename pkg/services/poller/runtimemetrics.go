@@ -0,0 +1,147 @@
+package poller
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func init() {
+	Register("runtime_metrics", func(cfg Config) (Collector, error) {
+		return newRuntimeMetricsCollector(cfg.Interval), nil
+	})
+}
+
+// histogramQuantiles are reported for histograms of runtime metrics.
+var histogramQuantiles = []float64{0.5, 0.9, 0.99, 1}
+
+// runtimeMetricsCollector collects all metrics supported by runtime/metrics without stopping the world.
+// Metric names are derived from the runtime names, e.g. /sched/goroutines:goroutines is
+// go_sched_goroutines_goroutines. Cumulative integer metrics are counters, the other scalars are gauges.
+// Histograms are reported as the count of samples and quantiles of the samples taken since the previous poll.
+type runtimeMetricsCollector struct {
+	interval time.Duration
+	samples  []metrics.Sample
+	// descriptions are descriptions of the samples by runtime name.
+	descriptions map[string]metrics.Description
+	// counters are the previous values of cumulative metrics, since the sink takes deltas.
+	counters Counters
+	// histograms are the previous bucket counts of histograms.
+	histograms map[string][]uint64
+}
+
+func newRuntimeMetricsCollector(interval time.Duration) *runtimeMetricsCollector {
+	c := &runtimeMetricsCollector{
+		interval:     interval,
+		descriptions: make(map[string]metrics.Description),
+		histograms:   make(map[string][]uint64),
+	}
+	for _, d := range metrics.All() {
+		c.samples = append(c.samples, metrics.Sample{Name: d.Name})
+		c.descriptions[d.Name] = d
+	}
+	return c
+}
+
+func (c *runtimeMetricsCollector) Name() string {
+	return "runtime_metrics"
+}
+
+func (c *runtimeMetricsCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *runtimeMetricsCollector) Collect(_ context.Context, sink Sink) error {
+	metrics.Read(c.samples)
+	for _, s := range c.samples {
+		d := c.descriptions[s.Name]
+		name := runtimeMetricName(s.Name)
+		md := types.Metadata{Description: d.Description, Unit: runtimeMetricUnit(s.Name), Owner: metadataOwner}
+
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			value := s.Value.Uint64()
+			if !d.Cumulative {
+				sink.SetGauge(name, types.Gauge(value))
+				sink.Describe(repository.Gauge, name, md)
+				continue
+			}
+			c.counters.Add(sink, name, value)
+			sink.Describe(repository.Counter, name, md)
+		case metrics.KindFloat64:
+			if value := s.Value.Float64(); !math.IsNaN(value) && !math.IsInf(value, 0) {
+				sink.SetGauge(name, types.Gauge(value))
+				sink.Describe(repository.Gauge, name, md)
+			}
+		case metrics.KindFloat64Histogram:
+			c.collectHistogram(s.Name, name, s.Value.Float64Histogram(), sink)
+			sink.Describe(repository.Gauge, name, md)
+			md.Description, md.Unit = "Number of samples of "+name+".", "samples"
+			sink.Describe(repository.Counter, name+"_count", md)
+		default:
+			// The metric is not supported by the runtime.
+		}
+	}
+	return nil
+}
+
+// collectHistogram reports the number of samples taken since the previous poll and their quantiles.
+// A quantile is the upper bound of its bucket, or the lower bound for the unbounded bucket. Quantiles are
+// removed if there are no new samples, so quantiles of the old ones are not reported again.
+func (c *runtimeMetricsCollector) collectHistogram(runtimeName, name string, h *metrics.Float64Histogram, sink Sink) {
+	prev := c.histograms[runtimeName]
+	deltas := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, count := range h.Counts {
+		deltas[i] = count
+		if i < len(prev) {
+			deltas[i] -= prev[i]
+		}
+		total += deltas[i]
+	}
+	c.histograms[runtimeName] = append(prev[:0], h.Counts...)
+
+	sink.AddCounter(name+"_count", types.Counter(total))
+	for _, q := range histogramQuantiles {
+		key := types.SeriesKey(name, types.Labels{"quantile": strconv.FormatFloat(q, 'g', -1, 64)})
+		if total == 0 {
+			sink.RemoveGauge(key)
+			continue
+		}
+		rank := uint64(math.Ceil(q * float64(total)))
+		var seen uint64
+		for i, count := range deltas {
+			if seen += count; seen < max(rank, 1) {
+				continue
+			}
+			value := h.Buckets[i+1]
+			if math.IsInf(value, 1) {
+				value = h.Buckets[i]
+			}
+			sink.SetGauge(key, types.Gauge(value))
+			break
+		}
+	}
+}
+
+// runtimeMetricName converts the runtime metric name like /gc/heap/allocs:bytes to go_gc_heap_allocs_bytes.
+func runtimeMetricName(name string) string {
+	return "go" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// runtimeMetricUnit returns the unit of the runtime metric name, e.g. bytes of /gc/heap/allocs:bytes.
+func runtimeMetricUnit(name string) string {
+	_, unit, _ := strings.Cut(name, ":")
+	return unit
+}
@@ -0,0 +1,265 @@
+package poller
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func init() {
+	Register("scrape", func(cfg Config) (Collector, error) {
+		urls := splitParam(cfg.Params["urls"])
+		if len(urls) == 0 {
+			return nil, errors.New("urls are required")
+		}
+		for _, u := range urls {
+			if parsed, err := url.Parse(u); err != nil || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid url %q", u)
+			}
+		}
+		timeout := cfg.Interval
+		if v, ok := cfg.Params["timeout"]; ok {
+			var err error
+			if timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid timeout %q: %w", v, err)
+			}
+		}
+		return newScrapeCollector(urls, cfg.Interval, timeout), nil
+	})
+}
+
+// scrapeCollector collects metrics from endpoints exposing Prometheus text format. Series are labelled
+// by the endpoint host as instance, the exposed instance label is renamed to exported_instance.
+// Gauges and untyped metrics are gauges, counters and counts of histograms and summaries are counters,
+// sums and quantiles are gauges.
+type scrapeCollector struct {
+	urls     []string
+	interval time.Duration
+	client   *http.Client
+	// counters keep totals of the previous scrape, since the sink takes deltas.
+	counters Counters
+	// series removes gauges which are gone.
+	series gaugeSeries
+}
+
+func newScrapeCollector(urls []string, interval, timeout time.Duration) *scrapeCollector {
+	return &scrapeCollector{
+		urls:     urls,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *scrapeCollector) Name() string {
+	return "scrape"
+}
+
+func (s *scrapeCollector) Interval() time.Duration {
+	return s.interval
+}
+
+func (s *scrapeCollector) Collect(ctx context.Context, sink Sink) error {
+	var errs error
+	tracked := s.series.track(sink)
+	for _, u := range s.urls {
+		if err := s.scrape(ctx, u, tracked); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", u, err))
+			// Series of the failed endpoint are kept until it is available again.
+			instance := instanceLabel(u)
+			s.series.keep(func(key string) bool {
+				_, labels, err := types.ParseSeriesKey(key)
+				return err == nil && labels["instance"] == instance
+			})
+		}
+	}
+	s.series.sweep(sink)
+	return errs
+}
+
+func instanceLabel(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+func (s *scrapeCollector) scrape(ctx context.Context, rawURL string, sink Sink) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	samples, err := parseExposition(resp.Body)
+	if err != nil {
+		return err
+	}
+	instance := instanceLabel(rawURL)
+	for _, smp := range samples {
+		if v, ok := smp.labels["instance"]; ok {
+			smp.labels["exported_instance"] = v
+		}
+		smp.labels["instance"] = instance
+		key := types.SeriesKey(smp.name, smp.labels)
+		if smp.counter {
+			s.counters.Add(sink, key, FloatTotal(smp.value))
+			if smp.help != "" {
+				sink.Describe(repository.Counter, smp.name, types.Metadata{Description: smp.help, Owner: metadataOwner})
+			}
+			continue
+		}
+		sink.SetGauge(key, types.Gauge(smp.value))
+		if smp.help != "" {
+			sink.Describe(repository.Gauge, smp.name, types.Metadata{Description: smp.help, Owner: metadataOwner})
+		}
+	}
+	return nil
+}
+
+// sample is a sample of Prometheus text format.
+type sample struct {
+	name    string
+	labels  types.Labels
+	value   float64
+	counter bool
+	help    string
+}
+
+// parseExposition parses Prometheus text format. Samples with non-finite values are skipped,
+// since they can't be stored, and so are samples with the name reserved by types.SelfPrefix.
+func parseExposition(r io.Reader) ([]sample, error) {
+	mTypes := make(map[string]string)
+	helps := make(map[string]string)
+	var samples []sample
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if comment, ok := strings.CutPrefix(line, "#"); ok {
+			// Comments look like "# TYPE name counter" or "# HELP name text", other comments are ignored.
+			fields := strings.SplitN(strings.TrimSpace(comment), " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[0] {
+			case "TYPE":
+				mTypes[fields[1]] = fields[2]
+			case "HELP":
+				helps[fields[1]] = unescapeHelp(fields[2])
+			default:
+			}
+			continue
+		}
+
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) || strings.HasPrefix(name, types.SelfPrefix) {
+			continue
+		}
+		family, counter := sampleFamily(name, mTypes)
+		samples = append(samples, sample{name: name, labels: labels, value: value, counter: counter, help: helps[family]})
+	}
+	return samples, scanner.Err()
+}
+
+// sampleFamily returns the metric family of the sample and whether the sample is a counter.
+func sampleFamily(name string, mTypes map[string]string) (string, bool) {
+	if mType, ok := mTypes[name]; ok {
+		return name, mType == "counter"
+	}
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		family, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		if mType := mTypes[family]; mType == "histogram" || mType == "summary" {
+			return family, suffix != "_sum"
+		}
+	}
+	return name, false
+}
+
+// parseSample parses line "name{label="value",...} value [timestamp]", the timestamp is ignored.
+func parseSample(line string) (string, types.Labels, float64, error) {
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return "", nil, 0, fmt.Errorf("invalid sample %q", line)
+	}
+	key, rest := line[:end], line[end:]
+	if rest[0] == '{' {
+		closing := labelsEnd(rest)
+		if closing < 0 {
+			return "", nil, 0, fmt.Errorf("invalid sample %q: unterminated labels", line)
+		}
+		key, rest = key+rest[:closing+1], rest[closing+1:]
+	}
+	name, labels, err := types.ParseSeriesKey(key)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	if labels == nil {
+		labels = make(types.Labels)
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("invalid sample %q: value is missing", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid sample %q: %w", line, err)
+	}
+	return name, labels, value, nil
+}
+
+// labelsEnd returns index of the brace closing labels or -1, braces in quoted values are skipped.
+func labelsEnd(s string) int {
+	quoted, escaped := false, false
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == '}' && !quoted:
+			return i
+		default:
+		}
+	}
+	return -1
+}
+
+var helpReplacer = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+func unescapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
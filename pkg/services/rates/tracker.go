@@ -0,0 +1,141 @@
+package rates
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+)
+
+// Tracker follows counter values reported by every source, detects counter resets
+// and computes per-second rates over the window.
+type Tracker struct {
+	mx     sync.Mutex
+	window time.Duration
+	series map[string]map[string]*source
+	now    func() time.Time
+}
+
+// source is a state of the counter reported by a single source.
+type source struct {
+	// epoch is incremented each time the source resets the counter.
+	epoch int
+	// last is the last raw value reported by the source.
+	last types.Counter
+	// offset is the sum of values reported before the resets, so offset+last never decreases.
+	offset  types.Counter
+	samples []sample
+}
+
+type sample struct {
+	ts    time.Time
+	value types.Counter
+}
+
+// New creates new Tracker with rate window.
+func New(window time.Duration) *Tracker {
+	return &Tracker{
+		window: window,
+		series: make(map[string]map[string]*source),
+		now:    time.Now,
+	}
+}
+
+// Observe registers the raw cumulative value of the counter reported by the source.
+// It returns the source epoch and true if the value is a counter reset.
+func (t *Tracker) Observe(key, src string, value types.Counter) (int, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	s, ok := t.source(key, src)
+	var reset bool
+	if ok && value < s.last {
+		s.epoch++
+		s.offset += s.last
+		reset = true
+	}
+	s.last = value
+	t.sample(s)
+	return s.epoch, reset
+}
+
+// ObserveDelta registers the increment of the counter reported by the source since its previous report.
+// Increments are never resets, so the epoch of the source is kept.
+func (t *Tracker) ObserveDelta(key, src string, delta types.Counter) int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	s, _ := t.source(key, src)
+	s.last += delta
+	t.sample(s)
+	return s.epoch
+}
+
+// source returns the state of the counter reported by the source and false if it is new.
+func (t *Tracker) source(key, src string) (*source, bool) {
+	sources, ok := t.series[key]
+	if !ok {
+		sources = make(map[string]*source)
+		t.series[key] = sources
+	}
+	s, ok := sources[src]
+	if !ok {
+		s = &source{}
+		sources[src] = s
+	}
+	return s, ok
+}
+
+// sample appends the current total of the source and drops samples out of the window.
+func (t *Tracker) sample(s *source) {
+	now := t.now()
+	s.samples = append(trim(s.samples, now.Add(-t.window)), sample{ts: now, value: s.offset + s.last})
+}
+
+// Rate returns per-second rate of the counter summed over all sources and false if the counter is unknown.
+func (t *Tracker) Rate(key string) (types.Gauge, bool) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	sources, ok := t.series[key]
+	if !ok {
+		return 0, false
+	}
+
+	var rate float64
+	from := t.now().Add(-t.window)
+	for src, s := range sources {
+		s.samples = trim(s.samples, from)
+		if len(s.samples) == 0 {
+			// Source has not reported within the window, its epoch is not tracked anymore.
+			delete(sources, src)
+			continue
+		}
+		first, last := s.samples[0], s.samples[len(s.samples)-1]
+		if elapsed := last.ts.Sub(first.ts).Seconds(); elapsed > 0 {
+			rate += float64(last.value-first.value) / elapsed
+		}
+	}
+	return types.Gauge(rate), true
+}
+
+// Resets returns number of counter resets detected for all tracked sources.
+func (t *Tracker) Resets(key string) int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var resets int
+	for _, s := range t.series[key] {
+		resets += s.epoch
+	}
+	return resets
+}
+
+// trim drops samples older than from.
+func trim(samples []sample, from time.Time) []sample {
+	i := 0
+	for i < len(samples) && samples[i].ts.Before(from) {
+		i++
+	}
+	return samples[i:]
+}
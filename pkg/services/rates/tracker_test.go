@@ -0,0 +1,103 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+)
+
+func TestTracker(t *testing.T) {
+	now := time.Now()
+	tracker := New(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	_, ok := tracker.Rate("pollcount")
+	require.False(t, ok)
+
+	tt := []struct {
+		name     string
+		src      string
+		value    types.Counter
+		expEpoch int
+		expReset bool
+		expRate  types.Gauge
+	}{
+		{
+			name:    "first_value",
+			src:     "agent1",
+			value:   0,
+			expRate: 0,
+		},
+		{
+			name:    "increase",
+			src:     "agent1",
+			value:   10,
+			expRate: 1,
+		},
+		{
+			name:    "another_source",
+			src:     "agent2",
+			value:   100,
+			expRate: 1,
+		},
+		{
+			name:     "reset",
+			src:      "agent1",
+			value:    5,
+			expEpoch: 1,
+			expReset: true,
+			// Values 0, 10, 15 in 30 seconds.
+			expRate: 0.5,
+		},
+		{
+			name:  "another_source_increase",
+			src:   "agent2",
+			value: 140,
+			// Values 100, 140 in 20 seconds.
+			expRate: 0.5 + 2,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			epoch, reset := tracker.Observe("pollcount", tc.src, tc.value)
+			require.Equal(t, tc.expEpoch, epoch)
+			require.Equal(t, tc.expReset, reset)
+
+			rate, ok := tracker.Rate("pollcount")
+			require.True(t, ok)
+			require.InDelta(t, float64(tc.expRate), float64(rate), 1e-9)
+			now = now.Add(10 * time.Second)
+		})
+	}
+	require.Equal(t, 1, tracker.Resets("pollcount"))
+
+	// All samples are out of the window.
+	now = now.Add(time.Hour)
+	rate, ok := tracker.Rate("pollcount")
+	require.True(t, ok)
+	require.Zero(t, rate)
+	require.Zero(t, tracker.Resets("pollcount"))
+}
+
+func TestTrackerDelta(t *testing.T) {
+	now := time.Now()
+	tracker := New(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	// Decreasing deltas are increments, not resets.
+	for _, delta := range []types.Counter{10, 20, 5} {
+		require.Zero(t, tracker.ObserveDelta("pollcount", "agent1", delta))
+		now = now.Add(10 * time.Second)
+	}
+	now = now.Add(-10 * time.Second)
+
+	rate, ok := tracker.Rate("pollcount")
+	require.True(t, ok)
+	// Totals 10, 30, 35 in 20 seconds.
+	require.InDelta(t, 1.25, float64(rate), 1e-9)
+	require.Zero(t, tracker.Resets("pollcount"))
+}
@@ -0,0 +1,171 @@
+package reporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+// sendBatchData sends all gauges and deltas of the counters which are not acknowledged by the server yet.
+func sendBatchData(ctx context.Context, repos map[string]repository.Repository, p *pool) {
+	// Replayed samples must not override newer ones on the server.
+	var ts int64
+	if p.o.outbox != nil {
+		ts = time.Now().UnixMilli()
+	}
+	metrics, err := collectMetrics(ctx, repos, p.deltas, ts)
+	if err != nil {
+		p.o.logf("[send/batch] Failed to collect data; %s\n", err)
+		return
+	}
+	if len(metrics) == 0 {
+		return
+	}
+
+	counters := repos[repository.Counter]
+	batches, err := encodeBatches(metrics, p.o.batchSize, p.o.labels)
+	if err != nil {
+		p.o.logf("[send/batch] Failed to encode data; %s\n", err)
+		p.deltas.settle(counters, batchDeltas(metrics), false)
+		return
+	}
+
+	for i, b := range batches {
+		j, err := batchJob(b.body, p.o)
+		if err != nil {
+			p.o.logf("[send/batch] Failed to compress data; %s\n", err)
+			for _, rest := range batches[i:] {
+				p.deltas.settle(counters, batchDeltas(rest.metrics), false)
+			}
+			return
+		}
+		deltas := batchDeltas(b.metrics)
+		j.settle = func(delivered bool) { p.deltas.settle(counters, deltas, delivered) }
+		p.enqueue(j)
+	}
+}
+
+// batchDeltas returns counter deltas of the metrics by series key.
+func batchDeltas(metrics []types.Metrics) map[string]types.Counter {
+	deltas := make(map[string]types.Counter)
+	for _, m := range metrics {
+		if m.MType == repository.Counter {
+			deltas[types.SeriesKey(m.ID, m.Labels)] = types.Counter(*m.Delta)
+		}
+	}
+	return deltas
+}
+
+// collectMetrics returns all gauges and counter deltas taken from the repositories as JSON metrics with
+// the timestamp in unix milliseconds, zero timestamp is omitted.
+func collectMetrics(ctx context.Context, repos map[string]repository.Repository, deltas *counterDeltas,
+	ts int64) ([]types.Metrics, error) {
+	var metrics []types.Metrics
+	for name, repo := range repos {
+		var err error
+		switch name {
+		case repository.Gauge:
+			err = repo.ForEach(ctx, func(k string, v []byte) error {
+				value := float64(types.BytesToGauge(v))
+				metrics = append(metrics, seriesMetrics(k, types.Metrics{MType: repository.Gauge, Value: &value, Timestamp: ts}))
+				return nil
+			})
+		case repository.Counter:
+			var taken map[string]types.Counter
+			taken, err = deltas.take(ctx, repo)
+			for k, v := range taken {
+				delta := int64(v)
+				metrics = append(metrics, seriesMetrics(k, types.Metrics{MType: repository.Counter, Delta: &delta, Timestamp: ts}))
+			}
+		default:
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+// seriesMetrics sets the metric name and labels from the series key.
+func seriesMetrics(key string, m types.Metrics) types.Metrics {
+	name, labels, err := types.ParseSeriesKey(key)
+	if err != nil {
+		name, labels = key, nil
+	}
+	m.ID, m.Labels = name, labels
+	return m
+}
+
+// encodedBatch is a JSON array of the metrics.
+type encodedBatch struct {
+	body    []byte
+	metrics []types.Metrics
+}
+
+// encodeBatches returns metrics with the labels added as JSON arrays of at most maxSize bytes, zero maxSize
+// means a single array. A metric which does not fit maxSize by itself is sent in its own array.
+func encodeBatches(metrics []types.Metrics, maxSize int, labels types.Labels) ([]encodedBatch, error) {
+	var (
+		batches []encodedBatch
+		batch   bytes.Buffer
+		first   int
+	)
+	for i, m := range metrics {
+		m.Labels = withLabels(m.Labels, labels)
+		item, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		// The closing bracket and the separator take one byte each.
+		if batch.Len() > 0 && maxSize > 0 && batch.Len()+len(item)+2 > maxSize {
+			batch.WriteByte(']')
+			batches = append(batches, encodedBatch{body: bytes.Clone(batch.Bytes()), metrics: metrics[first:i]})
+			batch.Reset()
+			first = i
+		}
+		if batch.Len() == 0 {
+			batch.WriteByte('[')
+		} else {
+			batch.WriteByte(',')
+		}
+		batch.Write(item)
+	}
+	if batch.Len() > 0 {
+		batch.WriteByte(']')
+		batches = append(batches, encodedBatch{body: batch.Bytes(), metrics: metrics[first:]})
+	}
+	return batches, nil
+}
+
+func batchJob(body []byte, o options) (job, error) {
+	header := http.Header{
+		"Content-Type":          []string{"application/json"},
+		types.CounterModeHeader: []string{types.CounterModeDelta},
+	}
+	if o.gzip {
+		var err error
+		if body, err = compress(body); err != nil {
+			return job{}, err
+		}
+		header.Set("Content-Encoding", "gzip")
+	}
+	return job{path: "/updates/", body: body, header: header}, nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,131 @@
+package reporter
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func TestEncodeBatches(t *testing.T) {
+	metrics := make([]types.Metrics, 0, 10)
+	for i := range 10 {
+		value := float64(i)
+		metrics = append(metrics, types.Metrics{ID: "gauge_" + strconv.Itoa(i), MType: repository.Gauge, Value: &value})
+	}
+	item, err := json.Marshal(metrics[0])
+	require.NoError(t, err)
+
+	tt := []struct {
+		name       string
+		maxSize    int
+		expBatches int
+	}{
+		{
+			name:       "no_limit",
+			maxSize:    0,
+			expBatches: 1,
+		},
+		{
+			name:       "three_per_batch",
+			maxSize:    3*len(item) + 4,
+			expBatches: 4,
+		},
+		{
+			name:       "too_small_limit",
+			maxSize:    1,
+			expBatches: 10,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			batches, err := encodeBatches(metrics, tc.maxSize, nil)
+			require.NoError(t, err)
+			require.Len(t, batches, tc.expBatches)
+
+			var decoded []types.Metrics
+			for _, batch := range batches {
+				if tc.maxSize > len(item)+2 {
+					require.LessOrEqual(t, len(batch.body), tc.maxSize)
+				}
+				var chunk []types.Metrics
+				require.NoError(t, json.Unmarshal(batch.body, &chunk))
+				require.Equal(t, batch.metrics, chunk)
+				decoded = append(decoded, chunk...)
+			}
+			require.Equal(t, metrics, decoded)
+		})
+	}
+}
+
+func TestSendBatchData(t *testing.T) {
+	var (
+		mx       sync.Mutex
+		requests int
+		received []types.Metrics
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/updates/", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var batch []types.Metrics
+		require.NoError(t, json.NewDecoder(gz).Decode(&batch))
+
+		mx.Lock()
+		defer mx.Unlock()
+		requests++
+		received = append(received, batch...)
+	}))
+	defer srv.Close()
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+	repos := repository.NewRepositories()
+	for i := range 30 {
+		repos[repository.Gauge].Set("gauge_"+strconv.Itoa(i), types.GaugeToBytes(types.Gauge(i)))
+	}
+	repos[repository.Counter].Set("PollCount", types.CounterToBytes(5))
+	repos[repository.Gauge].Set(types.SeriesKey("ProcessRSS", types.Labels{"pid": "1"}), types.GaugeToBytes(7))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	o := newOptions(WithBatch(0), WithGzip(), WithLabels(types.Labels{"host": "node1", "pid": "0"}))
+	sendBatchData(ctx, repos, newPool(ctx, srv.URL, client, o))
+	require.Eventually(t, func() bool { return o.stats.Sent() == 1 }, time.Second, 10*time.Millisecond)
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Equal(t, 1, requests)
+	require.Len(t, received, 32)
+	for _, m := range received {
+		if m.MType == repository.Counter {
+			require.Equal(t, "PollCount", m.ID)
+			require.Equal(t, int64(5), *m.Delta)
+		}
+		// Labels of the series take precedence over the extra ones.
+		if m.ID == "ProcessRSS" {
+			require.Equal(t, types.Labels{"host": "node1", "pid": "1"}, m.Labels)
+			require.Equal(t, float64(7), *m.Value)
+		} else {
+			require.Equal(t, types.Labels{"host": "node1", "pid": "0"}, m.Labels)
+		}
+	}
+	// The delivered delta is subtracted from the counter.
+	value, ok := repos[repository.Counter].Get("PollCount")
+	require.True(t, ok)
+	require.Zero(t, types.BytesToCounter(value))
+}
@@ -0,0 +1,70 @@
+package reporter
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+// counterDeltas tracks counter deltas being sent. Counters in the repository are deltas not acknowledged
+// by the server yet: a sent delta is subtracted from the repository once the server acknowledges it
+// or it is persisted to the outbox, so every increment is counted by the server once.
+type counterDeltas struct {
+	mx sync.Mutex
+	// inflight are deltas which are sent but neither acknowledged nor failed yet.
+	inflight map[string]types.Counter
+}
+
+func newCounterDeltas() *counterDeltas {
+	return &counterDeltas{inflight: make(map[string]types.Counter)}
+}
+
+// take returns non-zero deltas of the repository counters which are not being sent yet and marks them as being sent.
+func (d *counterDeltas) take(ctx context.Context, repo repository.Repository) (map[string]types.Counter, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	deltas := make(map[string]types.Counter)
+	err := repo.ForEach(ctx, func(k string, v []byte) error {
+		if delta := types.BytesToCounter(v) - d.inflight[k]; delta != 0 {
+			deltas[k] = delta
+			d.inflight[k] += delta
+		}
+		return nil
+	})
+	if err != nil {
+		d.release(deltas)
+		return nil, err
+	}
+	return deltas, nil
+}
+
+// settle subtracts acknowledged deltas from the repository, not delivered ones are sent again by the next report.
+// Both happen under the lock, so take never sees a delta which is subtracted but still in flight.
+func (d *counterDeltas) settle(repo repository.Repository, deltas map[string]types.Counter, delivered bool) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	if delivered {
+		for k, delta := range deltas {
+			repo.Update(k, func(v []byte, ok bool) []byte {
+				var value types.Counter
+				if ok {
+					value = types.BytesToCounter(v)
+				}
+				return types.CounterToBytes(value - delta)
+			})
+		}
+	}
+	d.release(deltas)
+}
+
+func (d *counterDeltas) release(deltas map[string]types.Counter) {
+	for k, delta := range deltas {
+		if d.inflight[k] -= delta; d.inflight[k] == 0 {
+			delete(d.inflight, k)
+		}
+	}
+}
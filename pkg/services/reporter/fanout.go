@@ -0,0 +1,295 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// Mode defines how requests are distributed between destinations.
+type Mode string
+
+const (
+	// Failover sends every request to the first healthy destination.
+	Failover Mode = "failover"
+	// Broadcast sends every request to all destinations.
+	Broadcast Mode = "broadcast"
+)
+
+// unhealthyPeriod is how long a failed destination is skipped before it is tried again.
+const unhealthyPeriod = 30 * time.Second
+
+var errUnhealthy = errors.New("destination is unhealthy")
+
+// ParseMode returns Mode by its name.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(strings.ToLower(s)); m {
+	case Failover, Broadcast:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown mode %q, expected %s or %s", s, Failover, Broadcast)
+	}
+}
+
+// DestinationStats are counters of a single destination.
+type DestinationStats struct {
+	Addr    string
+	Sent    int64
+	Failed  int64
+	Healthy bool
+}
+
+// destinationStats are counters of a destination kept by Stats, so they survive reloads.
+type destinationStats struct {
+	sent      atomic.Int64
+	failed    atomic.Int64
+	unhealthy atomic.Bool
+}
+
+// destination is a server the pool sends requests to.
+type destination struct {
+	addr  string
+	stats *destinationStats
+	logf  func(format string, args ...any)
+	mx    sync.Mutex
+	// retryAt is the time the unhealthy destination is tried again, it is zero for a healthy one.
+	retryAt time.Time
+}
+
+// available returns true if the destination is healthy or it is time to try it again.
+func (d *destination) available(now time.Time) bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return !now.Before(d.retryAt)
+}
+
+// observe counts the result of the request and updates health of the destination. Only retriable failures
+// make it unhealthy, since the others are caused by the request.
+func (d *destination) observe(err error, now time.Time, period time.Duration) {
+	if err == nil {
+		d.stats.sent.Add(1)
+	} else {
+		d.stats.failed.Add(1)
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	switch {
+	case err == nil || !isRetriable(err):
+		if !d.retryAt.IsZero() {
+			d.logf("[send] Destination %s is healthy\n", d.addr)
+		}
+		d.retryAt = time.Time{}
+		d.stats.unhealthy.Store(false)
+	default:
+		if d.retryAt.IsZero() {
+			d.logf("[send] Destination %s is unhealthy, it is skipped for %v\n", d.addr, period)
+		}
+		d.retryAt = now.Add(period)
+		d.stats.unhealthy.Store(true)
+	}
+}
+
+// destination returns counters of the destination, they are created on first use.
+func (s *Stats) destination(addr string) *destinationStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.destinations == nil {
+		s.destinations = make(map[string]*destinationStats)
+	}
+	ds, ok := s.destinations[addr]
+	if !ok {
+		ds = &destinationStats{}
+		s.destinations[addr] = ds
+	}
+	return ds
+}
+
+// Destinations returns counters of all destinations sorted by address.
+func (s *Stats) Destinations() []DestinationStats {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	res := make([]DestinationStats, 0, len(s.destinations))
+	for addr, ds := range s.destinations {
+		res = append(res, DestinationStats{
+			Addr:    addr,
+			Sent:    ds.sent.Load(),
+			Failed:  ds.failed.Load(),
+			Healthy: !ds.unhealthy.Load(),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+// deliver sends the job according to the mode. It returns true if any destination has accepted the job,
+// which may be the case for the failed job in broadcast mode.
+func (p *pool) deliver(ctx context.Context, j job) (bool, error) {
+	if p.o.mode == Broadcast {
+		return p.broadcast(ctx, j)
+	}
+	err := p.failover(ctx, j)
+	return err == nil, err
+}
+
+// failover sends the job to available destinations in order until one of them accepts it. If no destination
+// is available, all of them are tried.
+func (p *pool) failover(ctx context.Context, j job) error {
+	now := p.now()
+	candidates := make([]*destination, 0, len(p.dests))
+	for _, d := range p.dests {
+		if d.available(now) {
+			candidates = append(candidates, d)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.dests
+	}
+
+	var errs error
+	for _, d := range candidates {
+		err := p.postTo(ctx, d, j)
+		if err == nil {
+			return nil
+		}
+		errs = multierr.Append(errs, fmt.Errorf("%s: %w", d.addr, err))
+		// The request itself is rejected, so the other destinations would reject it too.
+		if !isRetriable(err) || ctx.Err() != nil {
+			return errs
+		}
+	}
+	return errs
+}
+
+// broadcast sends the job to all destinations concurrently. Destinations which already accepted the replayed
+// job are skipped, unhealthy ones fail the job until it is time to try them again. Without the outbox
+// counter jobs failed by some destinations are kept in memory, see unackedJobs.
+func (p *pool) broadcast(ctx context.Context, j job) (bool, error) {
+	now := p.now()
+	var (
+		wg        sync.WaitGroup
+		mx        sync.Mutex
+		errs      error
+		delivered bool
+	)
+	for _, d := range p.dests {
+		if p.pending.acked(j.id, d.addr) {
+			delivered = true
+			continue
+		}
+		if !d.available(now) {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", d.addr, errUnhealthy))
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.postTo(ctx, d, j)
+			mx.Lock()
+			defer mx.Unlock()
+			if err == nil {
+				p.pending.ack(j.id, d.addr)
+				delivered = true
+				return
+			}
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", d.addr, err))
+		}()
+	}
+	wg.Wait()
+	return delivered, errs
+}
+
+// unackedJobs are broadcast jobs with counter deltas which are accepted by some destinations and failed by
+// the others, when the outbox is not used. They are sent again by the next reports only to the destinations
+// which have not accepted them yet, and are settled once every destination accepts them, so the deltas are
+// neither lost for the failed destinations nor counted twice by the others. If more than limit jobs are
+// kept, the oldest one is settled as delivered and the failed destinations miss it.
+type unackedJobs struct {
+	mx    sync.Mutex
+	jobs  []job
+	limit int
+	// seq numbers the jobs, since acks of the destinations are tracked by the job id.
+	seq int
+}
+
+func newUnackedJobs(limit int) *unackedJobs {
+	return &unackedJobs{limit: limit}
+}
+
+// id returns the id of the new job.
+func (u *unackedJobs) id() string {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	u.seq++
+	return "broadcast-" + strconv.Itoa(u.seq)
+}
+
+// keep adds the job, it returns the job which is dropped to stay within the limit.
+func (u *unackedJobs) keep(j job) (job, bool) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	u.jobs = append(u.jobs, j)
+	if len(u.jobs) <= u.limit {
+		return job{}, false
+	}
+	dropped := u.jobs[0]
+	u.jobs = slices.Delete(u.jobs, 0, 1)
+	return dropped, true
+}
+
+// take removes at most n oldest jobs and returns them.
+func (u *unackedJobs) take(n int) []job {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+	n = min(n, len(u.jobs))
+	jobs := slices.Clone(u.jobs[:n])
+	u.jobs = slices.Delete(u.jobs, 0, n)
+	return jobs
+}
+
+func (p *pool) postTo(ctx context.Context, d *destination, j job) error {
+	err := post(ctx, p.client, d.addr+j.path, j.body, j.header, p.o)
+	// Requests aborted on stop say nothing about the destination.
+	if ctx.Err() == nil {
+		d.observe(err, p.now(), p.unhealthyPeriod)
+	}
+	return err
+}
+
+// activeDestinations returns addresses the requests are sent to now: all of them in broadcast mode
+// and the first available one in failover mode.
+func (p *pool) activeDestinations() string {
+	if p.o.mode == Broadcast {
+		addrs := make([]string, 0, len(p.dests))
+		for _, d := range p.dests {
+			addrs = append(addrs, d.addr)
+		}
+		return strings.Join(addrs, ",")
+	}
+	now := p.now()
+	for _, d := range p.dests {
+		if d.available(now) {
+			return d.addr
+		}
+	}
+	return p.dests[0].addr
+}
+
+// anyRetriable returns true if any of the combined errors is retriable.
+func anyRetriable(err error) bool {
+	for _, e := range multierr.Errors(err) {
+		if isRetriable(e) {
+			return true
+		}
+	}
+	return false
+}
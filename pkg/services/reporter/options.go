@@ -0,0 +1,197 @@
+package reporter
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/outbox"
+)
+
+// Option configures the reporter.
+type Option func(*options)
+
+// Config is the reporter setup applied on reload.
+type Config struct {
+	Addr string
+	// Interval keeps the current one if it is not positive.
+	Interval time.Duration
+	Client   *httpclient.Client
+	Options  []Option
+}
+
+type options struct {
+	batch     bool
+	batchSize int
+	gzip      bool
+	// retries are delays before retries of retriable failures.
+	retries []time.Duration
+	// rateLimit is the number of concurrent requests.
+	rateLimit int
+	// queueSize is the number of requests waiting for a free sender.
+	queueSize int
+	stats     *Stats
+	outbox    *outbox.Outbox
+	// key signs requests if it is set.
+	key string
+	// reload receives configs replacing the current one.
+	reload <-chan Config
+	// finalReport is the timeout of the report sent on stop, zero means no final report.
+	finalReport time.Duration
+	// mode distributes requests between the address and fanout destinations.
+	mode   Mode
+	fanout []string
+	// jitter is the max random delay of every report.
+	jitter time.Duration
+	// labels are added to every series, sourceID is sent in the X-Source-ID header if it is set.
+	labels   types.Labels
+	sourceID string
+	// logger receives the log of the reporter.
+	logger io.Writer
+}
+
+const (
+	defaultRateLimit = 1
+	defaultQueueSize = 256
+)
+
+func newOptions(opts ...Option) options {
+	o := options{
+		rateLimit: defaultRateLimit,
+		queueSize: defaultQueueSize,
+		mode:      Failover,
+		logger:    os.Stdout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.stats == nil {
+		o.stats = &Stats{}
+	}
+	return o
+}
+
+// logf writes the message to the log of the reporter.
+func (o options) logf(format string, args ...any) {
+	fmt.Fprintf(o.logger, format, args...)
+}
+
+// WithBatch makes the reporter send all gauges and counters as JSON batches of at most size bytes
+// instead of a request per metric. Zero size means a single batch.
+func WithBatch(size int) Option {
+	return func(o *options) {
+		o.batch = true
+		o.batchSize = size
+	}
+}
+
+// WithGzip makes the reporter compress batches with gzip.
+func WithGzip() Option {
+	return func(o *options) {
+		o.gzip = true
+	}
+}
+
+// WithRetries makes the reporter retry retriable failures after each of the delays.
+func WithRetries(delays ...time.Duration) Option {
+	return func(o *options) {
+		o.retries = delays
+	}
+}
+
+// WithRateLimit limits the number of concurrent requests to the server, n less than one means one.
+func WithRateLimit(n int) Option {
+	return func(o *options) {
+		o.rateLimit = max(n, 1)
+	}
+}
+
+// WithQueueSize sets the number of requests waiting for a free sender, requests beyond it are dropped.
+func WithQueueSize(n int) Option {
+	return func(o *options) {
+		o.queueSize = max(n, 0)
+	}
+}
+
+// WithStats makes the reporter count its requests in s.
+func WithStats(s *Stats) Option {
+	return func(o *options) {
+		o.stats = s
+	}
+}
+
+// WithOutbox makes the reporter persist every request to ob before sending and remove it after the server
+// acknowledges it. Requests left in ob are replayed on start and on every report.
+func WithOutbox(ob *outbox.Outbox) Option {
+	return func(o *options) {
+		o.outbox = ob
+	}
+}
+
+// WithFinalReport makes the reporter send the last report on stop and wait for it at most timeout.
+func WithFinalReport(timeout time.Duration) Option {
+	return func(o *options) {
+		o.finalReport = timeout
+	}
+}
+
+// WithKey makes the reporter sign request bodies with HMAC-SHA256 of the key in the HashSHA256 header.
+func WithKey(key string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithReload makes the reporter apply configs received from ch: the ticker is re-created with the new interval
+// and requests are sent by the new transport.
+func WithReload(ch <-chan Config) Option {
+	return func(o *options) {
+		o.reload = ch
+	}
+}
+
+// WithJitter delays every report by a random duration of up to max, so agents started together
+// don't report at the same time. Delays don't accumulate, reports are still sent every interval on average.
+func WithJitter(max time.Duration) Option {
+	return func(o *options) {
+		o.jitter = max
+	}
+}
+
+// WithLabels adds the labels to every reported series, e.g. the identity of the agent. Labels of the series
+// take precedence over them.
+func WithLabels(labels types.Labels) Option {
+	return func(o *options) {
+		o.labels = maps.Clone(labels)
+	}
+}
+
+// WithSourceID makes the reporter identify itself by id in the X-Source-ID header, so the server tracks
+// counters of agents behind the same address separately.
+func WithSourceID(id string) Option {
+	return func(o *options) {
+		o.sourceID = id
+	}
+}
+
+// WithFanout adds destinations after the address given to Send, the mode defines how requests are distributed
+// between them. Every destination is tracked separately: unhealthy ones are skipped for a while and
+// their requests are counted in Stats.Destinations.
+func WithFanout(mode Mode, addrs ...string) Option {
+	return func(o *options) {
+		o.mode = mode
+		o.fanout = addrs
+	}
+}
+
+// WithLogger makes the reporter write its log to w instead of os.Stdout, the logger is kept on reload.
+func WithLogger(w io.Writer) Option {
+	return func(o *options) {
+		o.logger = w
+	}
+}
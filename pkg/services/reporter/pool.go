@@ -0,0 +1,412 @@
+package reporter
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/outbox"
+)
+
+// job is a single request to the server.
+type job struct {
+	path   string
+	body   []byte
+	header http.Header
+	// done is called after the job is sent successfully.
+	done func()
+	// settle is called once the job is delivered or persisted to the outbox, or once it is dropped or failed.
+	settle func(delivered bool)
+	// id is the outbox entry of the job. Without the outbox it identifies counter jobs in broadcast mode,
+	// see unackedJobs, and it is empty for the other jobs.
+	id string
+}
+
+// settled calls settle of the job if it is not settled yet.
+func (j *job) settled(delivered bool) {
+	if j.settle != nil {
+		j.settle(delivered)
+		j.settle = nil
+	}
+}
+
+// LatencyBuckets are upper bounds of the request attempt latency histogram.
+var LatencyBuckets = [...]time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Stats are counters of the reporter sender pool, they are safe for concurrent use.
+type Stats struct {
+	queued  atomic.Int64
+	dropped atomic.Int64
+	sent    atomic.Int64
+	failed  atomic.Int64
+	bytes   atomic.Int64
+	// latency counts request attempts by the first bucket they fit, the last one is for the slower attempts.
+	latency    [len(LatencyBuckets) + 1]atomic.Int64
+	latencySum atomic.Int64
+
+	mx           sync.Mutex
+	destinations map[string]*destinationStats
+}
+
+// Latency is the histogram of request attempt latencies, every retry is a separate attempt.
+type Latency struct {
+	// Counts are cumulative numbers of attempts not slower than the bucket of the same index in LatencyBuckets,
+	// the last one is the number of all attempts.
+	Counts []int64
+	Sum    time.Duration
+}
+
+// QueueDepth returns the number of jobs waiting for a free sender.
+func (s *Stats) QueueDepth() int64 {
+	return s.queued.Load()
+}
+
+// Dropped returns the number of jobs dropped because the queue was full.
+func (s *Stats) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Sent returns the number of successfully sent jobs, in broadcast mode a job is sent when all destinations
+// accept it.
+func (s *Stats) Sent() int64 {
+	return s.sent.Load()
+}
+
+// Failed returns the number of jobs failed after all retries.
+func (s *Stats) Failed() int64 {
+	return s.failed.Load()
+}
+
+// BytesSent returns the number of body bytes of requests accepted by the servers.
+func (s *Stats) BytesSent() int64 {
+	return s.bytes.Load()
+}
+
+// Latency returns the histogram of latencies of all request attempts.
+func (s *Stats) Latency() Latency {
+	l := Latency{Counts: make([]int64, len(s.latency)), Sum: time.Duration(s.latencySum.Load())}
+	var total int64
+	for i := range s.latency {
+		total += s.latency[i].Load()
+		l.Counts[i] = total
+	}
+	return l
+}
+
+// observeRequest counts the request attempt which took d.
+func (s *Stats) observeRequest(d time.Duration, size int, err error) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	s.latency[i].Add(1)
+	s.latencySum.Add(int64(d))
+	if err == nil {
+		s.bytes.Add(int64(size))
+	}
+}
+
+// pool sends jobs from the bounded queue by a fixed number of workers, so at most rateLimit
+// requests are in flight and a slow request does not delay polling or the other requests.
+type pool struct {
+	dests  []*destination
+	jobs   chan job
+	client *httpclient.Client
+	o      options
+	stats  *Stats
+	wg     sync.WaitGroup
+	// cancel aborts requests being sent.
+	cancel  context.CancelFunc
+	pending *pendingSet
+	// deltas are counter deltas being sent, they are shared by pools replacing each other.
+	deltas *counterDeltas
+	// unacked are broadcast jobs failed by some destinations, they are shared by pools replacing each other.
+	unacked *unackedJobs
+	now     func() time.Time
+	// unhealthyPeriod is how long a failed destination is skipped.
+	unhealthyPeriod time.Duration
+}
+
+// pendingSet are outbox entries which are queued or being sent. It is shared by pools replacing
+// each other, so an entry is not replayed while the previous pool is sending it.
+type pendingSet struct {
+	mx  sync.Mutex
+	ids map[string]struct{}
+	// acks are destinations which accepted the entry in broadcast mode, so replays skip them.
+	acks map[string]map[string]struct{}
+}
+
+func newPendingSet() *pendingSet {
+	return &pendingSet{ids: make(map[string]struct{}), acks: make(map[string]map[string]struct{})}
+}
+
+func (s *pendingSet) add(id string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.ids[id] = struct{}{}
+}
+
+func (s *pendingSet) remove(id string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.ids, id)
+}
+
+func (s *pendingSet) has(id string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	_, ok := s.ids[id]
+	return ok
+}
+
+func (s *pendingSet) ack(id, addr string) {
+	if id == "" {
+		return
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.acks[id] == nil {
+		s.acks[id] = make(map[string]struct{})
+	}
+	s.acks[id][addr] = struct{}{}
+}
+
+func (s *pendingSet) acked(id, addr string) bool {
+	if id == "" {
+		return false
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	_, ok := s.acks[id][addr]
+	return ok
+}
+
+// clear removes acks of the entry.
+func (s *pendingSet) clear(id string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.acks, id)
+}
+
+// forget removes acks of the entries which are not in the outbox anymore.
+func (s *pendingSet) forget(keep func(id string) bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for id := range s.acks {
+		if !keep(id) {
+			delete(s.acks, id)
+		}
+	}
+}
+
+// newPool starts workers which send jobs to addr and the fan-out destinations until ctx is done.
+func newPool(ctx context.Context, addr string, client *httpclient.Client, o options) *pool {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pool{
+		cancel:          cancel,
+		jobs:            make(chan job, o.queueSize),
+		client:          client,
+		o:               o,
+		stats:           o.stats,
+		pending:         newPendingSet(),
+		deltas:          newCounterDeltas(),
+		unacked:         newUnackedJobs(o.queueSize),
+		now:             time.Now,
+		unhealthyPeriod: unhealthyPeriod,
+	}
+	for _, a := range append([]string{addr}, o.fanout...) {
+		p.dests = append(p.dests, &destination{addr: a, stats: o.stats.destination(a), logf: o.logf})
+	}
+	for i := 0; i < o.rateLimit; i++ {
+		p.wg.Add(1)
+		go p.work(ctx)
+	}
+	return p
+}
+
+// enqueue persists the job to the outbox if it is used and adds the job to the queue without blocking.
+// Without the outbox counter jobs get an id in broadcast mode, see unackedJobs.
+// The job is dropped from the queue if it is full, a persisted job is replayed later, so it is settled
+// as delivered once it is persisted.
+func (p *pool) enqueue(j job) bool {
+	if p.o.outbox != nil {
+		id, err := p.o.outbox.Put(outbox.Entry{Path: j.path, Header: j.header, Body: j.body})
+		if err != nil {
+			p.o.logf("[outbox] Failed to persist %s; %s\n", j.path, err)
+		} else {
+			j.settled(true)
+		}
+		j.id = id
+	} else if p.o.mode == Broadcast && j.settle != nil {
+		j.id = p.unacked.id()
+	}
+	return p.push(j)
+}
+
+func (p *pool) push(j job) bool {
+	if j.id != "" {
+		p.pending.add(j.id)
+	}
+	select {
+	case p.jobs <- j:
+		p.stats.queued.Add(1)
+		return true
+	default:
+		p.stats.dropped.Add(1)
+		p.release(j.id)
+		j.settled(false)
+		return false
+	}
+}
+
+// replay queues outbox entries which are neither queued nor being sent, from the oldest one
+// until the queue is full. Without the outbox it queues unacked broadcast jobs.
+func (p *pool) replay() {
+	if p.o.outbox == nil {
+		for _, j := range p.unacked.take(cap(p.jobs) - len(p.jobs)) {
+			p.push(j)
+		}
+		return
+	}
+	entries, err := p.o.outbox.List()
+	if err != nil {
+		p.o.logf("[outbox] Failed to list entries; %s\n", err)
+		return
+	}
+	ids := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		ids[e.ID] = struct{}{}
+	}
+	p.pending.forget(func(id string) bool {
+		_, ok := ids[id]
+		return ok
+	})
+	for _, e := range entries {
+		if len(p.jobs) == cap(p.jobs) {
+			return
+		}
+		if !p.pending.has(e.ID) {
+			p.push(job{path: e.Path, body: e.Body, header: e.Header, id: e.ID})
+		}
+	}
+}
+
+// timestamp returns the URL path suffix with the current time if the outbox is used, so replayed
+// samples do not override newer ones on the server.
+func (p *pool) timestamp() string {
+	if p.o.outbox == nil {
+		return ""
+	}
+	return "/" + strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+// release removes the outbox entry from the pending ones.
+func (p *pool) release(id string) {
+	if id == "" {
+		return
+	}
+	p.pending.remove(id)
+}
+
+func (p *pool) work(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j, ok := <-p.jobs:
+			if !ok {
+				return
+			}
+			p.stats.queued.Add(-1)
+			p.send(ctx, j)
+		}
+	}
+}
+
+func (p *pool) send(ctx context.Context, j job) {
+	defer p.release(j.id)
+
+	delivered, err := p.deliver(ctx, j)
+	if p.o.outbox == nil && j.id != "" {
+		p.settleBroadcast(ctx, j, delivered, err)
+	} else {
+		j.settled(delivered)
+	}
+	if err != nil {
+		p.stats.failed.Add(1)
+	} else {
+		p.stats.sent.Add(1)
+		if j.done != nil {
+			j.done()
+		}
+	}
+
+	// Retriable failures are kept in the outbox for replay, the others would never succeed.
+	if p.o.outbox != nil && j.id != "" && (err == nil || (ctx.Err() == nil && !anyRetriable(err))) {
+		if err = p.o.outbox.Remove(j.id); err != nil {
+			p.o.logf("[outbox] Failed to remove %s; %s\n", j.id, err)
+		}
+	}
+}
+
+// settleBroadcast settles the counter job sent without the outbox once every destination accepts it. The job
+// accepted by some destinations and failed by the others with retriable errors is kept for the next reports.
+func (p *pool) settleBroadcast(ctx context.Context, j job, delivered bool, err error) {
+	if delivered && err != nil && anyRetriable(err) && ctx.Err() == nil {
+		dropped, ok := p.unacked.keep(j)
+		if !ok {
+			return
+		}
+		p.o.logf("[send] Too many unacknowledged jobs, %s is dropped for the failed destinations\n", dropped.path)
+		j, delivered = dropped, true
+	}
+	j.settled(delivered)
+	p.pending.clear(j.id)
+}
+
+// wait blocks until all workers are stopped.
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+// close stops accepting jobs and waits until the queued ones are sent. If ctx is done first,
+// the requests being sent are aborted, the queued ones are discarded and ctx error is returned.
+func (p *pool) close(ctx context.Context) error {
+	close(p.jobs)
+	done := make(chan struct{})
+	go func() {
+		p.wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-done
+		p.discard()
+		return ctx.Err()
+	}
+}
+
+// discard settles the jobs left in the closed queue after the workers are stopped, so their counter deltas
+// are sent again by the next reports.
+func (p *pool) discard() {
+	for j := range p.jobs {
+		p.stats.queued.Add(-1)
+		p.release(j.id)
+		j.settled(false)
+	}
+}
@@ -0,0 +1,221 @@
+package reporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/pkg/services/outbox"
+)
+
+func TestPool(t *testing.T) {
+	t.Run("rate_limit", func(t *testing.T) {
+		var inFlight, maxInFlight atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+		}))
+		defer srv.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		o := newOptions(WithRateLimit(3))
+		p := newPool(ctx, srv.URL, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), o)
+		for range 12 {
+			require.True(t, p.enqueue(job{header: http.Header{}}))
+		}
+
+		require.Eventually(t, func() bool { return o.stats.Sent() == 12 }, 2*time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(3), maxInFlight.Load())
+		require.Zero(t, o.stats.QueueDepth())
+		require.Zero(t, o.stats.Dropped())
+	})
+
+	t.Run("drop_on_full_queue", func(t *testing.T) {
+		// Without workers the queue is never drained.
+		o := newOptions(WithQueueSize(2))
+		p := &pool{jobs: make(chan job, o.queueSize), o: o, stats: o.stats}
+		require.True(t, p.enqueue(job{}))
+		require.True(t, p.enqueue(job{}))
+		require.False(t, p.enqueue(job{}))
+		require.Equal(t, int64(2), o.stats.QueueDepth())
+		require.Equal(t, int64(1), o.stats.Dropped())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		o := newOptions()
+		p := newPool(ctx, srv.URL, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), o)
+		var done bool
+		p.enqueue(job{header: http.Header{}, done: func() { done = true }})
+
+		require.Eventually(t, func() bool { return o.stats.Failed() == 1 }, time.Second, 10*time.Millisecond)
+		require.False(t, done)
+		cancel()
+		p.wait()
+	})
+
+	t.Run("outbox", func(t *testing.T) {
+		var (
+			available atomic.Bool
+			received  atomic.Int64
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !available.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			require.Equal(t, "/updates/", r.URL.Path)
+			received.Add(1)
+		}))
+		defer srv.Close()
+
+		dir := t.TempDir()
+		ob, err := outbox.New(dir, 0, 0)
+		require.NoError(t, err)
+		client := httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second))
+
+		// The server is unavailable, so the job stays in the outbox.
+		ctx, cancel := context.WithCancel(context.Background())
+		o := newOptions(WithOutbox(ob))
+		p := newPool(ctx, srv.URL, client, o)
+		p.enqueue(job{path: "/updates/", body: []byte("[]"), header: http.Header{}})
+		require.Eventually(t, func() bool { return o.stats.Failed() == 1 }, time.Second, 10*time.Millisecond)
+		cancel()
+		p.wait()
+		entries, err := ob.List()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		// The job is replayed on start and removed after the server acknowledges it.
+		available.Store(true)
+		ob, err = outbox.New(dir, 0, 0)
+		require.NoError(t, err)
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		o = newOptions(WithOutbox(ob))
+		p = newPool(ctx, srv.URL, client, o)
+		p.replay()
+		require.Eventually(t, func() bool {
+			entries, err := ob.List()
+			return err == nil && len(entries) == 0
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(1), received.Load())
+	})
+
+	// fakeServer responds with the status and counts requests.
+	fakeServer := func(t *testing.T, status *atomic.Int64, received *atomic.Int64) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+			w.WriteHeader(int(status.Load()))
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+
+	t.Run("failover", func(t *testing.T) {
+		var statusA, statusB, receivedA, receivedB, now atomic.Int64
+		statusA.Store(http.StatusServiceUnavailable)
+		statusB.Store(http.StatusOK)
+		addrA, addrB := fakeServer(t, &statusA, &receivedA), fakeServer(t, &statusB, &receivedB)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		o := newOptions(WithFanout(Failover, addrB))
+		p := newPool(ctx, addrA, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), o)
+		p.now = func() time.Time { return time.Unix(now.Load(), 0) }
+
+		// The first destination fails, so the job is sent to the next one and the failed one is skipped.
+		for i := range 2 {
+			p.enqueue(job{header: http.Header{}})
+			require.Eventually(t, func() bool { return o.stats.Sent() == int64(i+1) }, time.Second, 10*time.Millisecond)
+		}
+		require.Equal(t, int64(1), receivedA.Load())
+		require.Equal(t, int64(2), receivedB.Load())
+		require.Equal(t, []DestinationStats{
+			{Addr: addrA, Failed: 1},
+			{Addr: addrB, Sent: 2, Healthy: true},
+		}, sortByAddr(o.stats.Destinations(), addrA, addrB))
+
+		// The recovered destination is used again after the unhealthy period.
+		statusA.Store(http.StatusOK)
+		now.Add(int64(unhealthyPeriod / time.Second))
+		p.enqueue(job{header: http.Header{}})
+		require.Eventually(t, func() bool { return o.stats.Sent() == 3 }, time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(2), receivedA.Load())
+		require.Equal(t, addrA, p.activeDestinations())
+	})
+
+	t.Run("broadcast", func(t *testing.T) {
+		var statusA, statusB, receivedA, receivedB, now atomic.Int64
+		statusA.Store(http.StatusOK)
+		statusB.Store(http.StatusServiceUnavailable)
+		addrA, addrB := fakeServer(t, &statusA, &receivedA), fakeServer(t, &statusB, &receivedB)
+
+		ob, err := outbox.New(t.TempDir(), 0, 0)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		o := newOptions(WithFanout(Broadcast, addrB), WithOutbox(ob))
+		p := newPool(ctx, addrA, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), o)
+		p.now = func() time.Time { return time.Unix(now.Load(), 0) }
+
+		// The job is kept in the outbox until all destinations accept it.
+		p.enqueue(job{header: http.Header{}})
+		require.Eventually(t, func() bool { return o.stats.Failed() == 1 }, time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(1), receivedA.Load())
+		require.Equal(t, int64(1), receivedB.Load())
+
+		// The unhealthy destination is skipped until the unhealthy period expires.
+		p.replay()
+		require.Eventually(t, func() bool { return o.stats.Failed() == 2 }, time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(1), receivedB.Load())
+
+		// The replayed job is sent only to the destination which has not accepted it.
+		statusB.Store(http.StatusOK)
+		now.Add(int64(unhealthyPeriod / time.Second))
+		p.replay()
+		require.Eventually(t, func() bool {
+			entries, err := ob.List()
+			return err == nil && len(entries) == 0
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, int64(1), receivedA.Load())
+		require.Equal(t, int64(2), receivedB.Load())
+		require.Equal(t, []DestinationStats{
+			{Addr: addrA, Sent: 1, Healthy: true},
+			{Addr: addrB, Sent: 1, Failed: 1, Healthy: true},
+		}, sortByAddr(o.stats.Destinations(), addrA, addrB))
+	})
+}
+
+// sortByAddr returns stats in the order of the addresses.
+func sortByAddr(stats []DestinationStats, addrs ...string) []DestinationStats {
+	res := make([]DestinationStats, 0, len(stats))
+	for _, addr := range addrs {
+		for _, s := range stats {
+			if s.Addr == addr {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
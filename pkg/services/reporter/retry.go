@@ -0,0 +1,109 @@
+package reporter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/signature"
+)
+
+// statusError is returned when the server responds with unexpected status.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status " + e.status
+}
+
+// post sends data to url and retries retriable failures according to the retry schedule.
+func post(ctx context.Context, client *httpclient.Client, url string, body []byte, header http.Header,
+	o options) error {
+	if o.key != "" || o.sourceID != "" {
+		header = header.Clone()
+	}
+	if o.key != "" {
+		header.Set(signature.Header, signature.Sign(o.key, body))
+	}
+	if o.sourceID != "" {
+		header.Set(types.SourceIDHeader, o.sourceID)
+	}
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err := postOnce(ctx, client, url, body, header)
+		o.stats.observeRequest(time.Since(start), len(body), err)
+		if err == nil {
+			if attempt > 1 {
+				o.logf("[send] Attempt %d to %s succeeded\n", attempt, url)
+			}
+			return nil
+		}
+		if attempt > len(o.retries) || !isRetriable(err) {
+			o.logf("[send] Attempt %d to %s failed; %s\n", attempt, url, err)
+			return err
+		}
+
+		delay := o.retries[attempt-1]
+		o.logf("[send] Attempt %d to %s failed, retry in %v; %s\n", attempt, url, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func postOnce(ctx context.Context, client *httpclient.Client, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if err = resp.Body.Close(); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// isRetriable returns true for failures which may disappear on retry: connection refused, timeouts,
+// server errors, too many requests and skipped unhealthy destinations.
+func isRetriable(err error) bool {
+	if errors.Is(err, errUnhealthy) {
+		return true
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError || se.code == http.StatusTooManyRequests
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	// Heimdall client returns transport errors as plain strings.
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") || strings.Contains(msg, "Client.Timeout") ||
+		strings.Contains(msg, "i/o timeout")
+}
@@ -0,0 +1,122 @@
+package reporter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gojek/heimdall/v7/httpclient"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/signature"
+)
+
+func TestPost(t *testing.T) {
+	retries := WithRetries(10*time.Millisecond, 10*time.Millisecond, 10*time.Millisecond)
+
+	tt := []struct {
+		name        string
+		statuses    []int
+		expAttempts int32
+		err         bool
+	}{
+		{
+			name:        "ok",
+			statuses:    []int{http.StatusOK},
+			expAttempts: 1,
+		},
+		{
+			name:        "server_error",
+			statuses:    []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK},
+			expAttempts: 3,
+		},
+		{
+			name:        "too_many_requests",
+			statuses:    []int{http.StatusTooManyRequests, http.StatusOK},
+			expAttempts: 2,
+		},
+		{
+			name:        "retries_exceeded",
+			statuses:    []int{http.StatusBadGateway},
+			expAttempts: 4,
+			err:         true,
+		},
+		{
+			name:        "not_retriable",
+			statuses:    []int{http.StatusBadRequest, http.StatusOK},
+			expAttempts: 1,
+			err:         true,
+		},
+	}
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := int(attempts.Add(1))
+				w.WriteHeader(tc.statuses[min(attempt, len(tc.statuses))-1])
+			}))
+			defer srv.Close()
+
+			o := newOptions(retries)
+			err := post(context.Background(), client, srv.URL, []byte("data"), http.Header{}, o)
+			if tc.err {
+				require.Error(t, err)
+				require.Zero(t, o.stats.BytesSent())
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, int64(len("data")), o.stats.BytesSent())
+			}
+			require.Equal(t, tc.expAttempts, attempts.Load())
+			// Every attempt is counted, local requests are faster than the largest bucket.
+			latency := o.stats.Latency()
+			require.Len(t, latency.Counts, len(LatencyBuckets)+1)
+			require.Equal(t, int64(tc.expAttempts), latency.Counts[len(LatencyBuckets)-1])
+			require.Equal(t, int64(tc.expAttempts), latency.Counts[len(LatencyBuckets)])
+			require.Positive(t, latency.Sum)
+		})
+	}
+
+	t.Run("connection_refused", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+
+		err := post(context.Background(), client, srv.URL, nil, http.Header{}, newOptions(retries))
+		require.Error(t, err)
+		require.True(t, isRetriable(err))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err := post(ctx, client, srv.URL, nil, http.Header{}, newOptions(WithRetries(time.Hour)))
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+	})
+}
+
+func TestPostSigned(t *testing.T) {
+	body := []byte("data")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.True(t, signature.Verify("secret", body, r.Header.Get(signature.Header)))
+		require.Equal(t, "agent1", r.Header.Get(types.SourceIDHeader))
+	}))
+	defer srv.Close()
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+	header := http.Header{}
+	require.NoError(t, post(context.Background(), client, srv.URL, body, header, newOptions(WithKey("secret"), WithSourceID("agent1"))))
+	// The header of the job is not modified, since the job may be replayed.
+	require.Empty(t, header.Get(signature.Header))
+	require.Empty(t, header.Get(types.SourceIDHeader))
+}
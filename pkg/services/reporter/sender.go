@@ -3,82 +3,263 @@ package reporter
 import (
 	"context"
 	"fmt"
+	"maps"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gojek/heimdall/v7/httpclient"
-	"go.uber.org/multierr"
 
 	"github.com/ASRafalsky/telemetry/internal/types"
 	"github.com/ASRafalsky/telemetry/pkg/services/repository"
 )
 
+// Send reports metrics from the repositories every interval until ctx is done. With WithFinalReport
+// it sends the last report on stop and returns an error if the report is not delivered.
 func Send(ctx context.Context, addr string, interval time.Duration, client *httpclient.Client,
-	repos map[string]repository.Repository) {
-	fmt.Printf("Reporeter started with interval %v\n", interval)
+	repos map[string]repository.Repository, opts ...Option) error {
+	o := newOptions(opts...)
+	o.logf("Reporter started with interval %v\n", interval)
+	// Requests are not aborted on stop, since they may be a part of the final report.
+	p := newPool(context.WithoutCancel(ctx), addr, client, o)
 
-	sendTimer := time.NewTicker(interval)
-	defer sendTimer.Stop()
+	// Requests left by the previous run are sent first.
+	p.replay()
 
-	for ctx.Err() == nil {
+	sendTimer := newReportTimer(interval, o.jitter)
+	defer func() { sendTimer.stop() }()
+
+	// Metadata is static, so it is sent once and only resent when it changes or it is sent to other destinations.
+	sentMetadata := &sync.Map{}
+	active := p.activeDestinations()
+
+	for {
 		select {
 		case <-ctx.Done():
-			return
-		case <-sendTimer.C:
-			for name := range repos {
-				switch name {
-				case repository.Gauge:
-					sendGaugeData(ctx, addr, repos[name], client)
-				case repository.Counter:
-					sendCounterData(ctx, addr, repos[name], client)
-				default:
-				}
+			if o.finalReport <= 0 {
+				p.cancel()
+				p.wait()
+				return nil
+			}
+			return sendFinalReport(repos, p, sentMetadata)
+		case <-sendTimer.timer.C:
+			sendTimer.next()
+			if a := p.activeDestinations(); a != active {
+				sentMetadata, active = &sync.Map{}, a
+			}
+			dropped := o.stats.Dropped()
+			report(ctx, repos, p, sentMetadata)
+			if n := o.stats.Dropped() - dropped; n > 0 {
+				o.logf("[send] Queue is full, %d requests dropped, queue depth %d\n", n, o.stats.QueueDepth())
+			}
+		case cfg := <-o.reload:
+			old := p
+			o = newOptions(append(cfg.Options, WithReload(o.reload), WithLogger(o.logger))...)
+			p = newPool(context.WithoutCancel(ctx), cfg.Addr, cfg.Client, o)
+			p.pending, p.deltas, p.unacked = old.pending, old.deltas, old.unacked
+			// Requests queued before reload are sent by the previous transport during the old interval.
+			go drain(old, interval)
+
+			if a := p.activeDestinations(); a != active {
+				sentMetadata, active = &sync.Map{}, a
+			}
+			if cfg.Interval > 0 {
+				interval = cfg.Interval
 			}
+			sendTimer.stop()
+			sendTimer = newReportTimer(interval, o.jitter)
+			o.logf("[send] Reloaded with destinations %s and interval %v\n", active, interval)
+		}
+	}
+}
+
+// reportTimer fires every interval, each time is delayed by a random jitter. Like time.Ticker it skips
+// the ticks missed by a slow report.
+type reportTimer struct {
+	timer    *time.Timer
+	interval time.Duration
+	jitter   time.Duration
+	// tick is the time of the current tick without the jitter.
+	tick time.Time
+}
+
+func newReportTimer(interval, jitter time.Duration) *reportTimer {
+	t := &reportTimer{interval: interval, jitter: jitter, tick: time.Now()}
+	t.timer = time.NewTimer(t.delay())
+	return t
+}
+
+// next schedules the timer to the next tick, it is called after the timer has fired.
+func (t *reportTimer) next() {
+	t.timer.Reset(t.delay())
+}
+
+// delay moves the tick to the next one which is not missed and returns the time left until it with the jitter.
+func (t *reportTimer) delay() time.Duration {
+	now := time.Now()
+	t.tick = t.tick.Add(t.interval)
+	if missed := now.Sub(t.tick); missed > 0 {
+		t.tick = t.tick.Add((missed/t.interval + 1) * t.interval)
+	}
+	delay := t.tick.Sub(now)
+	if t.jitter > 0 {
+		delay += rand.N(t.jitter)
+	}
+	return delay
+}
+
+func (t *reportTimer) stop() {
+	t.timer.Stop()
+}
+
+// drain stops the pool after the queued requests are sent or the timeout expires.
+func drain(p *pool, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.close(ctx); err != nil {
+		p.o.logf("[send] Previous transport is stopped with unsent requests; %s\n", err)
+	}
+}
+
+// report queues requests for all metrics in the repositories.
+func report(ctx context.Context, repos map[string]repository.Repository, p *pool, sentMetadata *sync.Map) {
+	p.replay()
+	if p.o.batch {
+		sendBatchData(ctx, repos, p)
+	}
+	for name := range repos {
+		switch {
+		case name == repository.Metadata:
+			sendMetadata(ctx, repos[name], p, sentMetadata)
+		case p.o.batch:
+			// Gauges and counters are already sent in batches.
+		case name == repository.Gauge:
+			sendGaugeData(ctx, repos[name], p)
+		case name == repository.Counter:
+			sendCounterData(ctx, repos[name], p)
+		default:
 		}
 	}
 }
 
-func sendCounterData(ctx context.Context, addr string, repo repository.Repository, client *httpclient.Client) {
+// sendFinalReport reports all metrics and waits until the requests are sent or the final report timeout expires.
+func sendFinalReport(repos map[string]repository.Repository, p *pool, sentMetadata *sync.Map) error {
+	p.o.logf("[send] Sending final report with timeout %v\n", p.o.finalReport)
+	ctx, cancel := context.WithTimeout(context.Background(), p.o.finalReport)
+	defer cancel()
+
+	dropped, failed := p.stats.Dropped(), p.stats.Failed()
+	report(ctx, repos, p, sentMetadata)
+	if err := p.close(ctx); err != nil {
+		return fmt.Errorf("final report is not finished: %w", err)
+	}
+	if n := p.stats.Dropped() - dropped; n > 0 {
+		return fmt.Errorf("final report is incomplete: %d requests dropped", n)
+	}
+	if n := p.stats.Failed() - failed; n > 0 {
+		return fmt.Errorf("final report is incomplete: %d requests failed", n)
+	}
+	return nil
+}
+
+// sendCounterData sends deltas of the counters which are not acknowledged by the server yet.
+func sendCounterData(ctx context.Context, repo repository.Repository, p *pool) {
+	header := http.Header{
+		"Content-Type":          []string{"text/plain"},
+		types.CounterModeHeader: []string{types.CounterModeDelta},
+	}
+	ts := p.timestamp()
+	deltas, err := p.deltas.take(ctx, repo)
+	if err != nil {
+		p.o.logf("[send/counter] Failed to send data; %s\n", err)
+		return
+	}
+	for k, delta := range deltas {
+		name, query := splitSeriesKey(k, p.o.labels)
+		taken := map[string]types.Counter{k: delta}
+		p.enqueue(job{
+			path:   "/update/counter/" + name + "/" + delta.String() + ts + query,
+			header: header,
+			settle: func(delivered bool) { p.deltas.settle(repo, taken, delivered) },
+		})
+	}
+}
+
+func sendGaugeData(ctx context.Context, repo repository.Repository, p *pool) {
 	header := http.Header{
 		"Content-Type": []string{"text/plain"},
 	}
-	var errRes error
+	ts := p.timestamp()
+	// Jobs are queued after the repository is read, since queueing may write to the outbox.
+	var jobs []job
 	err := repo.ForEach(ctx, func(k string, v []byte) error {
-		urlData := addr + "/update/counter/" + k + "/" + types.BytesToCounter(v).String()
-		resp, err := client.Post(urlData, nil, header)
-		if err != nil {
-			errRes = multierr.Append(errRes, fmt.Errorf("failed to send data for %s; %w", k, err))
-			return nil
-		}
-		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("[send/counter] Status code: %s\n", resp.Status)
-		}
-		return resp.Body.Close()
+		name, query := splitSeriesKey(k, p.o.labels)
+		jobs = append(jobs, job{path: "/update/gauge/" + name + "/" + types.BytesToGauge(v).String() + ts + query, header: header})
+		return nil
 	})
-	if errRes = multierr.Append(errRes, err); err != nil {
-		fmt.Printf("[send/counter] Failed to send data; %s\n", err)
+	if err != nil {
+		p.o.logf("[send/gauge] Failed to send data; %s\n", err)
+		return
+	}
+	for _, j := range jobs {
+		p.enqueue(j)
 	}
 }
 
-func sendGaugeData(ctx context.Context, addr string, repo repository.Repository, client *httpclient.Client) {
-	header := http.Header{
-		"Content-Type": []string{"text/plain"},
+// splitSeriesKey returns the metric name and labels of the series key with the extra labels encoded as URL query.
+func splitSeriesKey(key string, extra types.Labels) (string, string) {
+	name, labels, err := types.ParseSeriesKey(key)
+	if err != nil {
+		name, labels = key, nil
+	}
+	labels = withLabels(labels, extra)
+	if len(labels) == 0 {
+		return name, ""
 	}
+	query := make(url.Values, len(labels))
+	for label, value := range labels {
+		query.Set(label, value)
+	}
+	return name, "?" + query.Encode()
+}
 
-	var errRes error
+// withLabels returns labels of the series with the extra labels, the series labels take precedence.
+func withLabels(labels, extra types.Labels) types.Labels {
+	if len(extra) == 0 {
+		return labels
+	}
+	res := maps.Clone(extra)
+	maps.Copy(res, labels)
+	return res
+}
+
+// sendMetadata sends metadata which differs from the already sent one, sent is updated by the senders.
+func sendMetadata(ctx context.Context, repo repository.Repository, p *pool, sent *sync.Map) {
+	header := http.Header{
+		"Content-Type": []string{"application/json"},
+	}
+	var jobs []job
 	err := repo.ForEach(ctx, func(k string, v []byte) error {
-		urlData := addr + "/update/gauge/" + k + "/" + types.BytesToGauge(v).String()
-		resp, err := client.Post(urlData, nil, header)
-		if err != nil {
-			errRes = multierr.Append(errRes, fmt.Errorf("failed to send data for %s; %w", k, err))
+		if prev, ok := sent.Load(k); ok && prev.(string) == string(v) {
 			return nil
 		}
-		if resp.StatusCode != http.StatusOK {
-			fmt.Printf("[send/counter] Status code: %s\n", resp.Status)
-		}
-		return resp.Body.Close()
+		mType, name := repository.SplitMetadataKey(k)
+		value := string(v)
+		jobs = append(jobs, job{
+			path:   "/meta/" + mType + "/" + name,
+			body:   v,
+			header: header,
+			done:   func() { sent.Store(k, value) },
+		})
+		return nil
 	})
-	if errRes = multierr.Append(errRes, err); err != nil {
-		fmt.Printf("[send/counter] Failed to send data; %s\n", err)
+	if err != nil {
+		p.o.logf("[send/metadata] Failed to send data; %s\n", err)
+		return
+	}
+	for _, j := range jobs {
+		p.enqueue(j)
 	}
 }
@@ -2,8 +2,12 @@ package reporter
 
 import (
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,7 +23,7 @@ const testValStr = "1234"
 
 func TestSend(t *testing.T) {
 	var (
-		gFound, cFound bool
+		gFound, cFound atomic.Bool
 	)
 
 	// Add handlers and router.
@@ -29,7 +33,7 @@ func TestSend(t *testing.T) {
 			require.Equal(t, r.Header.Get("Content-Type"), "text/plain")
 			value := chi.URLParam(r, "value")
 			require.Equal(t, testValStr, value)
-			gFound = true
+			gFound.Store(true)
 		}
 	}
 	counterHandler := func() http.HandlerFunc {
@@ -38,7 +42,7 @@ func TestSend(t *testing.T) {
 			require.Equal(t, r.Header.Get("Content-Type"), "text/plain")
 			value := chi.URLParam(r, "value")
 			require.Equal(t, testValStr, value)
-			cFound = true
+			cFound.Store(true)
 		}
 	}
 
@@ -71,8 +75,342 @@ func TestSend(t *testing.T) {
 	repos[repository.Gauge].Set("gauge_var", types.GaugeToBytes(gaugeData))
 	repos[repository.Counter].Set("counter_var", types.CounterToBytes(counterData))
 
-	sendGaugeData(context.Background(), srv.URL, repos[repository.Gauge], client)
-	sendCounterData(context.Background(), srv.URL, repos[repository.Counter], client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPool(ctx, srv.URL, client, newOptions())
+	sendGaugeData(ctx, repos[repository.Gauge], p)
+	sendCounterData(ctx, repos[repository.Counter], p)
 
-	require.Eventually(t, func() bool { return gFound && cFound }, 200*time.Millisecond, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return gFound.Load() && cFound.Load() }, 200*time.Millisecond, 50*time.Millisecond)
+}
+
+func TestSendCounterDeltas(t *testing.T) {
+	var (
+		status atomic.Int64
+		mx     sync.Mutex
+		values []string
+	)
+	r := chi.NewRouter()
+	r.Post("/update/counter/{name}/{value}", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, types.CounterModeDelta, r.Header.Get(types.CounterModeHeader))
+		mx.Lock()
+		values = append(values, chi.URLParam(r, "value"))
+		mx.Unlock()
+		w.WriteHeader(int(status.Load()))
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	repo := repository.NewRepositories()[repository.Counter]
+	add := func(delta types.Counter) {
+		repo.Update("PollCount", func(v []byte, ok bool) []byte {
+			return types.CounterToBytes(types.BytesToCounter(v) + delta)
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := newPool(ctx, srv.URL, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), newOptions())
+	// send reports the counter and waits until the request is settled.
+	send := func(expected types.Counter) {
+		sendCounterData(ctx, repo, p)
+		require.Eventually(t, func() bool {
+			p.deltas.mx.Lock()
+			defer p.deltas.mx.Unlock()
+			v, _ := repo.Get("PollCount")
+			return len(p.deltas.inflight) == 0 && types.BytesToCounter(v) == expected
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// The rejected delta is kept and sent again with the next increments.
+	add(5)
+	status.Store(http.StatusBadRequest)
+	send(5)
+	add(2)
+	status.Store(http.StatusOK)
+	send(0)
+	// Nothing is sent without increments.
+	send(0)
+	add(3)
+	send(0)
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Equal(t, []string{"5", "7", "3"}, values)
+}
+
+func TestSendCounterDeltasBroadcast(t *testing.T) {
+	type destination struct {
+		status atomic.Int64
+		mx     sync.Mutex
+		values []string
+	}
+	newDestination := func() (*destination, string) {
+		d := &destination{}
+		d.status.Store(http.StatusOK)
+		r := chi.NewRouter()
+		r.Post("/update/counter/{name}/{value}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(int(d.status.Load()))
+			if d.status.Load() == http.StatusOK {
+				d.mx.Lock()
+				d.values = append(d.values, chi.URLParam(r, "value"))
+				d.mx.Unlock()
+			}
+		})
+		srv := httptest.NewServer(r)
+		t.Cleanup(srv.Close)
+		return d, srv.URL
+	}
+	a, addrA := newDestination()
+	b, addrB := newDestination()
+
+	repo := repository.NewRepositories()[repository.Counter]
+	add := func(delta types.Counter) {
+		repo.Update("PollCount", func(v []byte, ok bool) []byte {
+			if ok {
+				delta += types.BytesToCounter(v)
+			}
+			return types.CounterToBytes(delta)
+		})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	o := newOptions(WithFanout(Broadcast, addrB), WithRetries())
+	p := newPool(ctx, addrA, httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second)), o)
+	p.unhealthyPeriod = 0
+	// report sends the unacked jobs and the counter, then waits until the requests are handled.
+	report := func(failed, sent int64) {
+		p.replay()
+		sendCounterData(ctx, repo, p)
+		require.Eventually(t, func() bool {
+			return o.stats.Failed() == failed && o.stats.Sent() == sent
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// The delta accepted by A only is kept until B accepts it, A doesn't receive it again.
+	add(5)
+	b.status.Store(http.StatusServiceUnavailable)
+	report(1, 0)
+	add(2)
+	report(3, 0)
+	b.status.Store(http.StatusOK)
+	report(3, 2)
+
+	v, _ := repo.Get("PollCount")
+	require.Equal(t, types.Counter(0), types.BytesToCounter(v))
+	p.deltas.mx.Lock()
+	require.Empty(t, p.deltas.inflight)
+	p.deltas.mx.Unlock()
+	require.Equal(t, []string{"5", "2"}, a.values)
+	require.ElementsMatch(t, []string{"5", "2"}, b.values)
+}
+
+func TestReportTimer(t *testing.T) {
+	start := time.Now().Add(-150 * time.Second)
+	timer := &reportTimer{interval: time.Minute, jitter: 10 * time.Second, tick: start}
+
+	// Missed ticks are skipped, the next one is 30 seconds later.
+	delay := timer.delay()
+	require.Equal(t, start.Add(3*time.Minute), timer.tick)
+	require.GreaterOrEqual(t, delay, 29*time.Second)
+	require.Less(t, delay, 40*time.Second)
+
+	// Jitter doesn't move the ticks.
+	timer.delay()
+	require.Equal(t, start.Add(4*time.Minute), timer.tick)
+}
+
+func TestSplitSeriesKey(t *testing.T) {
+	name, query := splitSeriesKey("Alloc", nil)
+	require.Equal(t, "Alloc", name)
+	require.Empty(t, query)
+
+	key := types.SeriesKey("ProcessRSS", types.Labels{"process": "my app", "pid": "1"})
+	name, query = splitSeriesKey(key, nil)
+	require.Equal(t, "ProcessRSS", name)
+	require.Equal(t, "?pid=1&process=my+app", query)
+
+	// Labels of the series take precedence over the extra ones.
+	name, query = splitSeriesKey(key, types.Labels{"host": "node1", "pid": "2"})
+	require.Equal(t, "ProcessRSS", name)
+	require.Equal(t, "?host=node1&pid=1&process=my+app", query)
+	_, query = splitSeriesKey("Alloc", types.Labels{"host": "node1"})
+	require.Equal(t, "?host=node1", query)
+}
+
+func TestSendMetadata(t *testing.T) {
+	var received atomic.Int64
+
+	r := chi.NewRouter()
+	r.Post("/meta/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, repository.Gauge, chi.URLParam(r, "type"))
+		require.Equal(t, "gauge_var", chi.URLParam(r, "name"))
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		buf, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		md, err := types.ParseMetadata(buf)
+		require.NoError(t, err)
+		require.Equal(t, "bytes", md.Unit)
+		received.Add(1)
+	})
+
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(1000 * time.Millisecond))
+	repos := repository.NewRepositories()
+	repos[repository.Metadata].Set(repository.MetadataKey(repository.Gauge, "gauge_var"),
+		types.MetadataToBytes(types.Metadata{Unit: "bytes"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	o := newOptions()
+	p := newPool(ctx, srv.URL, client, o)
+
+	var sent sync.Map
+	sendMetadata(ctx, repos[repository.Metadata], p, &sent)
+	require.Eventually(t, func() bool { return o.stats.Sent() == 1 }, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(1), received.Load())
+
+	// Already sent metadata is not sent again.
+	sendMetadata(ctx, repos[repository.Metadata], p, &sent)
+	require.Zero(t, o.stats.QueueDepth())
+	require.Equal(t, int64(1), received.Load())
+}
+
+func TestSendFinalReport(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "delivered", status: http.StatusOK},
+		{name: "failed", status: http.StatusBadRequest, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received atomic.Int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/update/gauge/gauge_var/"+testValStr, r.URL.Path)
+				received.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			repos := repository.NewRepositories()
+			gaugeData, err := types.ParseGauge(testValStr)
+			require.NoError(t, err)
+			repos[repository.Gauge].Set("gauge_var", types.GaugeToBytes(gaugeData))
+
+			// The interval is too long for regular reports, so only the final one is sent.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			client := httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second))
+			err = Send(ctx, srv.URL, time.Hour, client, repos, WithFinalReport(time.Second))
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, int64(1), received.Load())
+		})
+	}
+}
+
+func TestSendReload(t *testing.T) {
+	newServer := func(received *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received.Add(1)
+		}))
+	}
+	var first, second atomic.Int64
+	srv1, srv2 := newServer(&first), newServer(&second)
+	defer srv1.Close()
+	defer srv2.Close()
+
+	repos := repository.NewRepositories()
+	repos[repository.Gauge].Set("gauge_var", types.GaugeToBytes(1))
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second))
+	reload := make(chan Config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = Send(ctx, srv1.URL, 20*time.Millisecond, client, repos, WithReload(reload))
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return first.Load() > 0 }, time.Second, 10*time.Millisecond)
+
+	// After reload the data is sent to the new server only.
+	reload <- Config{Addr: srv2.URL, Interval: 10 * time.Millisecond, Client: client, Options: []Option{WithBatch(0)}}
+	require.Eventually(t, func() bool { return second.Load() >= 3 }, time.Second, 10*time.Millisecond)
+	sent := first.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, sent, first.Load())
+
+	cancel()
+	<-done
+}
+
+func TestSendReloadOutage(t *testing.T) {
+	var (
+		down     atomic.Bool
+		received atomic.Int64
+	)
+	up := make(chan struct{})
+	r := chi.NewRouter()
+	r.Post("/update/counter/{name}/{value}", func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			// Requests hang until the server is up or they are aborted.
+			select {
+			case <-up:
+			case <-r.Context().Done():
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		value, err := strconv.ParseInt(chi.URLParam(r, "value"), 10, 64)
+		require.NoError(t, err)
+		received.Add(value)
+	})
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	repos := repository.NewRepositories()
+	var polled int64
+	poll := func() {
+		repos[repository.Counter].Update("PollCount", func(v []byte, ok bool) []byte {
+			return types.CounterToBytes(types.BytesToCounter(v) + 1)
+		})
+		polled++
+	}
+
+	client := httpclient.NewClient(httpclient.WithHTTPTimeout(time.Second))
+	reload := make(chan Config)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	down.Store(true)
+	go func() {
+		_ = Send(ctx, srv.URL, 10*time.Millisecond, client, repos, WithReload(reload))
+		close(done)
+	}()
+
+	// Reports are queued behind the hanging request, then the previous pool is cancelled with them.
+	for i := 0; i < 5; i++ {
+		poll()
+		time.Sleep(15 * time.Millisecond)
+	}
+	reload <- Config{Addr: srv.URL, Client: client}
+	time.Sleep(50 * time.Millisecond)
+
+	// Deltas of the discarded requests are sent again once the server is up.
+	down.Store(false)
+	close(up)
+	poll()
+	require.Eventually(t, func() bool {
+		v, _ := repos[repository.Counter].Get("PollCount")
+		return received.Load() == polled && types.BytesToCounter(v) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
 }
@@ -2,18 +2,21 @@ package repository
 
 import (
 	"context"
+	"strings"
 
 	"github.com/ASRafalsky/telemetry/internal/storage"
 )
 
 const (
-	Gauge   = "gauge"
-	Counter = "counter"
+	Gauge    = "gauge"
+	Counter  = "counter"
+	Metadata = "metadata"
 )
 
 type Repository interface {
 	Set(k string, v []byte)
 	Get(k string) ([]byte, bool)
+	Update(k string, fn func(v []byte, ok bool) []byte) []byte
 	ForEach(ctx context.Context, fn func(k string, v []byte) error) error
 	Size() int
 	Delete(k string)
@@ -21,7 +24,19 @@ type Repository interface {
 
 func NewRepositories() map[string]Repository {
 	return map[string]Repository{
-		Gauge:   storage.New[string, []byte](),
-		Counter: storage.New[string, []byte](),
+		Gauge:    storage.New[string, []byte](),
+		Counter:  storage.New[string, []byte](),
+		Metadata: storage.New[string, []byte](),
 	}
 }
+
+// MetadataKey returns key of the metric metadata in the Metadata repository.
+func MetadataKey(mType, name string) string {
+	return mType + "/" + name
+}
+
+// SplitMetadataKey returns metric type and name from the Metadata repository key.
+func SplitMetadataKey(key string) (mType, name string) {
+	mType, name, _ = strings.Cut(key, "/")
+	return mType, name
+}
@@ -0,0 +1,32 @@
+package signature
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature(t *testing.T) {
+	data := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	sig := Sign("secret", data)
+	require.Len(t, sig, 64)
+
+	tests := []struct {
+		name string
+		key  string
+		data []byte
+		sig  string
+		want bool
+	}{
+		{name: "valid", key: "secret", data: data, sig: sig, want: true},
+		{name: "wrong_key", key: "other", data: data, sig: sig},
+		{name: "modified_data", key: "secret", data: []byte("[]"), sig: sig},
+		{name: "not_hex", key: "secret", data: data, sig: "signature"},
+		{name: "empty", key: "secret", data: data},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Verify(tt.key, tt.data, tt.sig))
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// Package sink defines where collected metrics are written to. It has no dependencies on collectors,
+// so it can be used by the client library without registering them.
+package sink
+
+import (
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+// Sink receives metrics from collectors, it is safe for concurrent use.
+type Sink interface {
+	SetGauge(name string, value types.Gauge)
+	AddCounter(name string, delta types.Counter)
+	// RemoveGauge removes the gauge, e.g. the series of a finished process.
+	RemoveGauge(name string)
+	// Describe sets metadata of the metric of the type, see repository.Gauge and repository.Counter.
+	Describe(mType, name string, md types.Metadata)
+}
+
+// repoSink stores metrics in the agent repositories.
+type repoSink struct {
+	repos map[string]repository.Repository
+}
+
+// New returns Sink which stores metrics in the repositories.
+func New(repos map[string]repository.Repository) Sink {
+	return &repoSink{repos: repos}
+}
+
+func (s *repoSink) SetGauge(name string, value types.Gauge) {
+	s.repos[repository.Gauge].Set(name, types.GaugeToBytes(value))
+}
+
+func (s *repoSink) RemoveGauge(name string) {
+	s.repos[repository.Gauge].Delete(name)
+}
+
+func (s *repoSink) AddCounter(name string, delta types.Counter) {
+	s.repos[repository.Counter].Update(name, func(v []byte, ok bool) []byte {
+		if ok {
+			delta += types.BytesToCounter(v)
+		}
+		return types.CounterToBytes(delta)
+	})
+}
+
+func (s *repoSink) Describe(mType, name string, md types.Metadata) {
+	if repo, ok := s.repos[repository.Metadata]; ok {
+		repo.Set(repository.MetadataKey(mType, name), types.MetadataToBytes(md))
+	}
+}
@@ -0,0 +1,35 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func TestSink(t *testing.T) {
+	repos := repository.NewRepositories()
+	s := New(repos)
+
+	s.SetGauge("temperature", 21.5)
+	s.AddCounter("requests", 2)
+	s.AddCounter("requests", 3)
+	s.Describe(repository.Counter, "requests", types.Metadata{Unit: "requests"})
+
+	value, ok := repos[repository.Gauge].Get("temperature")
+	require.True(t, ok)
+	assert.Equal(t, types.Gauge(21.5), types.BytesToGauge(value))
+	value, ok = repos[repository.Counter].Get("requests")
+	require.True(t, ok)
+	assert.Equal(t, types.Counter(5), types.BytesToCounter(value))
+	value, ok = repos[repository.Metadata].Get(repository.MetadataKey(repository.Counter, "requests"))
+	require.True(t, ok)
+	assert.Equal(t, "requests", types.BytesToMetadata(value).Unit)
+
+	s.RemoveGauge("temperature")
+	_, ok = repos[repository.Gauge].Get("temperature")
+	assert.False(t, ok)
+}
@@ -0,0 +1,324 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/naming"
+	"github.com/ASRafalsky/telemetry/pkg/services/poller"
+)
+
+// Metric types of the StatsD protocol.
+const (
+	Counter = "c"
+	Gauge   = "g"
+	Timer   = "ms"
+	// Histogram is an alias of Timer.
+	Histogram = "h"
+	Set       = "s"
+)
+
+// maxPacketSize is enough for the largest UDP datagram.
+const maxPacketSize = 64 << 10
+
+// maxIdleFlushes is the number of flushes without updates after which a gauge is forgotten by Server,
+// so names which are not used anymore do not pile up. A relative update of a forgotten gauge starts from 0.
+const maxIdleFlushes = 60
+
+// maxTimerSamples limits samples of a timer kept between flushes, percentiles of more samples are
+// computed from a uniform random sample of them.
+const maxTimerSamples = 1024
+
+// percentiles are reported for timers in addition to count, min, max and mean.
+var percentiles = []float64{50, 90, 99}
+
+// Metric is a parsed StatsD line "name:value|type|@rate".
+type Metric struct {
+	Name string
+	Type string
+	// Value is the number for all types but Set, gauges with signed value are relative if Delta is set.
+	Value float64
+	Delta bool
+	// Member is the raw value of Set.
+	Member string
+	// Rate is the sample rate of counters and timers, 1 if it is not set.
+	Rate float64
+}
+
+// Parse returns the metric of the StatsD line. Names are limited to the charset of naming.Policy,
+// since characters like / or { would make a different series key or URL path.
+func Parse(line string) (Metric, error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok || name == "" {
+		return Metric{}, errors.New("metric name is missing")
+	}
+	if _, err := naming.Preserve.Normalize(name); err != nil {
+		return Metric{}, err
+	}
+	if strings.HasPrefix(name, types.SelfPrefix) {
+		return Metric{}, fmt.Errorf("metric name prefix %q is reserved", types.SelfPrefix)
+	}
+	parts := strings.Split(rest, "|")
+	if len(parts) < 2 || parts[0] == "" {
+		return Metric{}, errors.New("metric value or type is missing")
+	}
+
+	m := Metric{Name: name, Type: parts[1], Rate: 1}
+	for _, part := range parts[2:] {
+		rate, ok := strings.CutPrefix(part, "@")
+		if !ok {
+			return Metric{}, fmt.Errorf("unknown section %q", part)
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 || r > 1 {
+			return Metric{}, fmt.Errorf("invalid sample rate %q", rate)
+		}
+		m.Rate = r
+	}
+
+	switch m.Type {
+	case Set:
+		m.Member = parts[0]
+		return m, nil
+	case Gauge:
+		m.Delta = parts[0][0] == '+' || parts[0][0] == '-'
+	case Counter, Timer, Histogram:
+	default:
+		return Metric{}, fmt.Errorf("unknown metric type %q", m.Type)
+	}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Metric{}, fmt.Errorf("invalid value %q", parts[0])
+	}
+	m.Value = value
+	return m, nil
+}
+
+// Server receives StatsD metrics and aggregates them until they are flushed to the sink.
+// Counters are summed, gauges keep the last value, timers are summarized as count, min, max, mean
+// and percentiles, sets are reported as the number of unique members.
+type Server struct {
+	mx sync.Mutex
+	// counters keep the fractional part of scaled counters between flushes.
+	counters map[string]float64
+	// gauges keep values of gauges, since relative updates need the current value.
+	gauges map[string]float64
+	// idle is the number of flushes since the last update of the gauge, it is 0 for changed gauges.
+	idle   map[string]int
+	timers map[string]*timer
+	sets   map[string]map[string]struct{}
+}
+
+// timer keeps min, max and sum of all samples, but at most maxTimerSamples of them for percentiles.
+type timer struct {
+	// values are a reservoir of the samples, every sample is kept with the same probability.
+	values        []float64
+	min, max, sum float64
+	// seen is the number of samples, count is the number of samples scaled by the sample rate.
+	seen  int
+	count float64
+}
+
+// add adds the sample, it replaces a random one once the reservoir is full.
+func (t *timer) add(value, rate float64) {
+	if t.seen == 0 {
+		t.min, t.max = value, value
+	}
+	t.min, t.max, t.sum = min(t.min, value), max(t.max, value), t.sum+value
+	t.seen++
+	t.count += 1 / rate
+	if len(t.values) < maxTimerSamples {
+		t.values = append(t.values, value)
+	} else if i := rand.N(t.seen); i < maxTimerSamples {
+		t.values[i] = value
+	}
+}
+
+// New creates Server.
+func New() *Server {
+	return &Server{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		idle:     make(map[string]int),
+		timers:   make(map[string]*timer),
+		sets:     make(map[string]map[string]struct{}),
+	}
+}
+
+// Add aggregates the metric until the next flush.
+func (s *Server) Add(m Metric) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch m.Type {
+	case Counter:
+		s.counters[m.Name] += m.Value / m.Rate
+	case Gauge:
+		if m.Delta {
+			s.gauges[m.Name] += m.Value
+		} else {
+			s.gauges[m.Name] = m.Value
+		}
+		s.idle[m.Name] = 0
+	case Timer, Histogram:
+		t, ok := s.timers[m.Name]
+		if !ok {
+			t = &timer{}
+			s.timers[m.Name] = t
+		}
+		t.add(m.Value, m.Rate)
+	case Set:
+		members, ok := s.sets[m.Name]
+		if !ok {
+			members = make(map[string]struct{})
+			s.sets[m.Name] = members
+		}
+		members[m.Member] = struct{}{}
+	default:
+	}
+}
+
+// Handle parses and aggregates the packet of newline separated lines. It returns an error for every invalid line.
+func (s *Server) Handle(packet []byte) error {
+	var errs error
+	for _, line := range strings.Split(string(packet), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		m, err := Parse(line)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%q: %w", line, err))
+			continue
+		}
+		s.Add(m)
+	}
+	return errs
+}
+
+// Flush writes metrics aggregated since the previous flush to the sink.
+func (s *Server) Flush(sink poller.Sink) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for name, value := range s.counters {
+		// Scaled counters may be fractional, the rest is kept for the next flush.
+		whole := math.Trunc(value)
+		if whole != 0 {
+			sink.AddCounter(name, types.Counter(whole))
+		}
+		if value -= whole; value == 0 {
+			delete(s.counters, name)
+		} else {
+			s.counters[name] = value
+		}
+	}
+	for name, n := range s.idle {
+		if n == 0 {
+			sink.SetGauge(name, types.Gauge(s.gauges[name]))
+		}
+		if n++; n > maxIdleFlushes {
+			delete(s.gauges, name)
+			delete(s.idle, name)
+		} else {
+			s.idle[name] = n
+		}
+	}
+	for name, t := range s.timers {
+		t.flush(name, sink)
+	}
+	clear(s.timers)
+	for name, members := range s.sets {
+		sink.SetGauge(name, types.Gauge(len(members)))
+	}
+	clear(s.sets)
+}
+
+func (t *timer) flush(name string, sink poller.Sink) {
+	sort.Float64s(t.values)
+	sink.AddCounter(name+".count", types.Counter(math.Round(t.count)))
+	sink.SetGauge(name+".min", types.Gauge(t.min))
+	sink.SetGauge(name+".max", types.Gauge(t.max))
+	sink.SetGauge(name+".mean", types.Gauge(t.sum/float64(t.seen)))
+	for _, p := range percentiles {
+		// Nearest rank percentile.
+		rank := int(math.Ceil(p / 100 * float64(len(t.values))))
+		sink.SetGauge(name+".p"+strconv.Itoa(int(p)), types.Gauge(t.values[max(rank, 1)-1]))
+	}
+}
+
+// Listen opens the packet connection on the network address, the network is udp or unixgram.
+// A stale unix socket file is removed.
+func Listen(network, addr string) (net.PacketConn, error) {
+	if network == "unixgram" {
+		if err := os.Remove(addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return net.ListenPacket(network, addr)
+}
+
+// Serve aggregates packets received on the connection until ctx is done, then it closes the connection.
+func (s *Server) Serve(ctx context.Context, conn net.PacketConn) error {
+	defer func() {
+		if addr, ok := conn.LocalAddr().(*net.UnixAddr); ok {
+			_ = os.Remove(addr.Name)
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer func() {
+		if stop() {
+			conn.Close()
+		}
+	}()
+
+	fmt.Printf("[statsd] Listening on %s %s\n", conn.LocalAddr().Network(), conn.LocalAddr())
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err = s.Handle(buf[:n]); err != nil {
+			fmt.Printf("[statsd] Failed to parse metrics; %s\n", err)
+		}
+	}
+}
+
+// Collector returns the collector which flushes metrics to the sink every interval.
+func (s *Server) Collector(interval time.Duration) poller.Collector {
+	return &collector{server: s, interval: interval}
+}
+
+type collector struct {
+	server   *Server
+	interval time.Duration
+}
+
+func (c *collector) Name() string {
+	return "statsd"
+}
+
+func (c *collector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *collector) Collect(_ context.Context, sink poller.Sink) error {
+	c.server.Flush(sink)
+	return nil
+}
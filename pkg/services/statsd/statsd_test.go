@@ -0,0 +1,173 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ASRafalsky/telemetry/internal/types"
+	"github.com/ASRafalsky/telemetry/pkg/services/poller"
+	"github.com/ASRafalsky/telemetry/pkg/services/repository"
+)
+
+func TestParse(t *testing.T) {
+	tt := []struct {
+		line     string
+		expected Metric
+		err      bool
+	}{
+		{line: "requests:1|c", expected: Metric{Name: "requests", Type: Counter, Value: 1, Rate: 1}},
+		{line: "requests:2|c|@0.5", expected: Metric{Name: "requests", Type: Counter, Value: 2, Rate: 0.5}},
+		{line: "queue:10|g", expected: Metric{Name: "queue", Type: Gauge, Value: 10, Rate: 1}},
+		{line: "queue:-3|g", expected: Metric{Name: "queue", Type: Gauge, Value: -3, Delta: true, Rate: 1}},
+		{line: "latency:12.5|ms|@0.1", expected: Metric{Name: "latency", Type: Timer, Value: 12.5, Rate: 0.1}},
+		{line: "size:7|h", expected: Metric{Name: "size", Type: Histogram, Value: 7, Rate: 1}},
+		{line: "users:alice|s", expected: Metric{Name: "users", Type: Set, Member: "alice", Rate: 1}},
+		{line: "requests", err: true},
+		{line: ":1|c", err: true},
+		{line: "requests:1", err: true},
+		{line: "requests:|c", err: true},
+		{line: "requests:x|c", err: true},
+		{line: "requests:1|x", err: true},
+		{line: "requests:1|c|@2", err: true},
+		{line: "requests:1|c|#tag:value", err: true},
+		{line: "queue:NaN|g", err: true},
+		{line: "__agent_queue_depth:1|g", err: true},
+		{line: "api.requests-total_2:1|c", expected: Metric{Name: "api.requests-total_2", Type: Counter, Value: 1, Rate: 1}},
+		{line: "requests/api:1|c", err: true},
+		{line: `requests{path="/"}:1|c`, err: true},
+		{line: "requests,env=prod:1|c", err: true},
+		{line: `"requests":1|c`, err: true},
+		{line: "request count:1|c", err: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.line, func(t *testing.T) {
+			m, err := Parse(tc.line)
+			if tc.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, m)
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	repos := repository.NewRepositories()
+	sink := poller.NewSink(repos)
+	s := New()
+
+	require.Error(t, s.Handle([]byte("requests:1|c\nbroken\nrequests:1|c|@0.4\n\n"+
+		"queue:10|g\nqueue:+5|g\nqueue:-3|g\n"+
+		"users:alice|s\nusers:bob|s\nusers:alice|s\n")))
+	for i := 1; i <= 10; i++ {
+		s.Add(Metric{Name: "latency", Type: Timer, Value: float64(i), Rate: 0.5})
+	}
+	s.Flush(sink)
+
+	gauge := func(name string) float64 {
+		value, ok := repos[repository.Gauge].Get(name)
+		require.True(t, ok, name)
+		return float64(types.BytesToGauge(value))
+	}
+	counter := func(name string) int64 {
+		value, ok := repos[repository.Counter].Get(name)
+		require.True(t, ok, name)
+		return int64(types.BytesToCounter(value))
+	}
+	// 1 + 1/0.4 = 3.5, the half is kept for the next flush.
+	assert.Equal(t, int64(3), counter("requests"))
+	assert.Equal(t, 12.0, gauge("queue"))
+	assert.Equal(t, 2.0, gauge("users"))
+	assert.Equal(t, int64(20), counter("latency.count"))
+	for name, expected := range map[string]float64{
+		"latency.min": 1, "latency.max": 10, "latency.mean": 5.5,
+		"latency.p50": 5, "latency.p90": 9, "latency.p99": 10,
+	} {
+		assert.Equal(t, expected, gauge(name), name)
+	}
+
+	// Gauges are relative to the last value, sets and timers start over.
+	require.NoError(t, s.Handle([]byte("requests:1|c|@0.4\nqueue:+1|g\nusers:carol|s\nlatency:20|ms")))
+	s.Flush(sink)
+	assert.Equal(t, int64(6), counter("requests"))
+	assert.Equal(t, 13.0, gauge("queue"))
+	assert.Equal(t, 1.0, gauge("users"))
+	assert.Equal(t, int64(21), counter("latency.count"))
+	assert.Equal(t, 20.0, gauge("latency.min"))
+
+	// Samples kept for percentiles are limited, the other statistics cover all of them.
+	for i := 1; i <= 10*maxTimerSamples; i++ {
+		s.Add(Metric{Name: "latency", Type: Timer, Value: float64(i), Rate: 1})
+	}
+	s.mx.Lock()
+	require.Len(t, s.timers["latency"].values, maxTimerSamples)
+	s.mx.Unlock()
+	s.Flush(sink)
+	assert.Equal(t, int64(21+10*maxTimerSamples), counter("latency.count"))
+	assert.Equal(t, 1.0, gauge("latency.min"))
+	assert.Equal(t, float64(10*maxTimerSamples), gauge("latency.max"))
+	assert.Equal(t, float64(10*maxTimerSamples+1)/2, gauge("latency.mean"))
+	assert.InDelta(t, 5*maxTimerSamples, gauge("latency.p50"), maxTimerSamples)
+
+	// Idle gauges are forgotten, the reported value is kept.
+	for range maxIdleFlushes {
+		s.Flush(sink)
+	}
+	s.mx.Lock()
+	require.Empty(t, s.gauges)
+	s.mx.Unlock()
+	assert.Equal(t, 13.0, gauge("queue"))
+	require.NoError(t, s.Handle([]byte("queue:+1|g")))
+	s.Flush(sink)
+	assert.Equal(t, 1.0, gauge("queue"))
+}
+
+func TestServe(t *testing.T) {
+	dir, err := os.MkdirTemp("", "statsd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "statsd.sock")
+
+	for network, addr := range map[string]string{"udp": "127.0.0.1:0", "unixgram": socket} {
+		t.Run(network, func(t *testing.T) {
+			s := New()
+			conn, err := Listen(network, addr)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.Serve(ctx, conn) }()
+
+			client, err := net.Dial(network, conn.LocalAddr().String())
+			require.NoError(t, err)
+			_, err = client.Write([]byte("requests:2|c\nqueue:7|g"))
+			require.NoError(t, err)
+			require.NoError(t, client.Close())
+
+			repos := repository.NewRepositories()
+			collector := s.Collector(time.Second)
+			require.Eventually(t, func() bool {
+				require.NoError(t, collector.Collect(ctx, poller.NewSink(repos)))
+				_, ok := repos[repository.Gauge].Get("queue")
+				return ok
+			}, time.Second, 10*time.Millisecond)
+			value, ok := repos[repository.Counter].Get("requests")
+			require.True(t, ok)
+			require.Equal(t, types.Counter(2), types.BytesToCounter(value))
+
+			cancel()
+			require.NoError(t, <-done)
+		})
+	}
+	// The socket file is removed on stop.
+	_, err = os.Stat(socket)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
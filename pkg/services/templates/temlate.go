@@ -13,11 +13,30 @@ func PrepareTemplate() *template.Template {
 </head>
 <body>
     <h1>Keys:</h1>
-    <ul>
+    <table>
+        <tr>
+            <th>Name</th>
+            <th>Labels</th>
+            <th>Type</th>
+            <th>Aggregation</th>
+            <th>Unit</th>
+            <th>Description</th>
+            <th>Owner</th>
+            <th>Updated</th>
+        </tr>
         {{range .}}
-        <li>{{.}}</li>
+        <tr>
+            <td>{{.Name}}</td>
+            <td>{{.Labels}}</td>
+            <td>{{.Type}}</td>
+            <td>{{.Aggregation}}</td>
+            <td>{{.Unit}}</td>
+            <td>{{.Description}}</td>
+            <td>{{.Owner}}</td>
+            <td>{{.Updated}}</td>
+        </tr>
         {{end}}
-    </ul>
+    </table>
 </body>
 </html>
 `